@@ -0,0 +1,75 @@
+package messagedb
+
+// Aggregate tracks the version of an entity stream across the load, decide,
+// append cycle so that staged messages are written with optimistic
+// concurrency.
+type Aggregate struct {
+	StreamName string
+	// Messages are the messages already in the stream.
+	Messages Messages
+	// Version is the position of the last message in the stream, or -1 when
+	// the stream is empty.
+	Version int
+
+	messageDB MessageDB
+	pending   Messages
+}
+
+// LoadAggregate reads every message in the entity stream and records its
+// version.
+func LoadAggregate(messageDB MessageDB, streamName string) (*Aggregate, error) {
+	if streamName == "" {
+		return nil, ErrStreamNameRequired
+	}
+	msgs, err := messageDB.ReadAll(streamName)
+	if err != nil {
+		return nil, err
+	}
+	a := &Aggregate{
+		StreamName: streamName,
+		Messages:   msgs,
+		Version:    noStreamVersion,
+		messageDB:  messageDB,
+	}
+	if len(msgs) > 0 {
+		a.Version = msgs[len(msgs)-1].Position
+	}
+	return a, nil
+}
+
+// Append stages a message to be written by Save and returns it so that its
+// metadata can be filled in.
+func (a *Aggregate) Append(messageType string, data map[string]interface{}) *Message {
+	msg := NewMessage(a.StreamName, messageType)
+	msg.Data = data
+	a.pending = append(a.pending, msg)
+	return msg
+}
+
+// Pending returns the staged messages that have not been saved.
+func (a *Aggregate) Pending() Messages {
+	return a.pending
+}
+
+// Save writes the staged messages in order, each expecting the version left
+// by the one before it. If another writer has appended to the stream since it
+// was loaded, Save returns ErrVersionConflict and the messages not yet written
+// remain pending. Each message is written in its own transaction.
+func (a *Aggregate) Save() error {
+	for len(a.pending) > 0 {
+		msg := a.pending[0]
+		expectedVersion := a.Version
+		msg.ExpectedVersion = &expectedVersion
+
+		position, err := a.messageDB.Write(msg)
+		if err != nil {
+			return err
+		}
+
+		msg.Position = position
+		a.Version = position
+		a.Messages = append(a.Messages, msg)
+		a.pending = a.pending[1:]
+	}
+	return nil
+}
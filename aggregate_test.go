@@ -0,0 +1,90 @@
+package messagedb_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestAggregate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "Opened", 0, 10, nil, nil, time.Now()).
+			AddRow(uuid.New(), streamName, "Deposited", 1, 11, nil, nil, time.Now()))
+
+	a, err := messagedb.LoadAggregate(messagedb.New(db), streamName)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when loading aggregate", err)
+	}
+	if a.Version != 1 {
+		t.Errorf("got version %d, want %d", a.Version, 1)
+	}
+
+	a.Append("Withdrawn", map[string]interface{}{"amount": 1})
+	a.Append("Withdrawn", map[string]interface{}{"amount": 2})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "Withdrawn", []uint8(`{"amount":1}`), []uint8("null"), 1).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("2"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "Withdrawn", []uint8(`{"amount":2}`), []uint8("null"), 2).
+		WillReturnError(errors.New("Wrong expected version: 2 (Stream: account-1, Stream Version: 3)"))
+	mock.ExpectRollback()
+
+	err = a.Save()
+	if _, ok := err.(messagedb.ErrVersionConflict); !ok {
+		t.Errorf("got %v, want error version conflict", err)
+	}
+	if a.Version != 2 {
+		t.Errorf("got version %d, want %d", a.Version, 2)
+	}
+	if len(a.Messages) != 3 {
+		t.Errorf("got %d messages, want %d", len(a.Messages), 3)
+	}
+	if len(a.Pending()) != 1 {
+		t.Errorf("got %d pending messages, want %d", len(a.Pending()), 1)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestLoadAggregateEmpty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WillReturnRows(mock.NewRows(columns))
+
+	a, err := messagedb.LoadAggregate(messagedb.New(db), "account-2")
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when loading aggregate", err)
+	}
+	if a.Version != -1 {
+		t.Errorf("got version %d, want %d", a.Version, -1)
+	}
+}
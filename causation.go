@@ -0,0 +1,114 @@
+package messagedb
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"time"
+)
+
+// Follow records cause as the message that caused m, copying its correlation
+// and reply stream names unless m already has its own.
+func (m *Message) Follow(cause *Message) {
+	if m.Metadata == nil {
+		m.Metadata = &Metadata{}
+	}
+	m.Metadata.CausationMessageStreamName = cause.StreamName
+	m.Metadata.CausationMessagePosition = cause.Position
+	m.Metadata.CausationMessageGlobalPosition = cause.GlobalPosition
+	if m.Metadata.CorrelationStreamName == "" {
+		m.Metadata.CorrelationStreamName = cause.CorrelationStreamName()
+	}
+	if m.Metadata.ReplyStreamName == "" {
+		m.Metadata.ReplyStreamName = cause.ReplyStreamName()
+	}
+}
+
+// CausedBy returns a MessageDB whose writes follow cause, so that messages a
+// Subscriber writes while handling cause record it as their causation without
+// copying metadata by hand:
+//
+//	func(msg *messagedb.Message) error {
+//		_, err := messagedb.CausedBy(m, msg).Write(messagedb.NewMessage("account-1", "Credited"))
+//		return err
+//	}
+//
+// This covers every method that writes messages the caller gives it: the
+// Write methods, WriteAndAwaitReply's command, and the messages of
+// ImportStream and MigrateStream. Messages that already record a causation
+// message are written unchanged.
+func CausedBy(messageDB MessageDB, cause *Message) MessageDB {
+	return causedBy{messageDB, cause}
+}
+
+type causedBy struct {
+	MessageDB
+	cause *Message
+}
+
+func (c causedBy) follow(msgs ...*Message) {
+	for _, msg := range msgs {
+		if msg.CausationMessageStreamName() == "" {
+			msg.Follow(c.cause)
+		}
+	}
+}
+
+func (c causedBy) Write(msg *Message) (int, error) {
+	c.follow(msg)
+	return c.MessageDB.Write(msg)
+}
+
+func (c causedBy) WriteMany(streamName string, expectedVersion *int, msgs Messages) (int, error) {
+	c.follow(msgs...)
+	return c.MessageDB.WriteMany(streamName, expectedVersion, msgs)
+}
+
+func (c causedBy) WriteSequence(streamName string, startVersion int, msgs Messages) (int, error) {
+	c.follow(msgs...)
+	return c.MessageDB.WriteSequence(streamName, startVersion, msgs)
+}
+
+func (c causedBy) WriteContext(ctx context.Context, msg *Message) (int, error) {
+	c.follow(msg)
+	return c.MessageDB.WriteContext(ctx, msg)
+}
+
+func (c causedBy) WriteIf(streamName string, fold func(Messages) (ok bool, expectedVersion int), msg *Message) (int, error) {
+	c.follow(msg)
+	return c.MessageDB.WriteIf(streamName, fold, msg)
+}
+
+func (c causedBy) WriteTx(tx *sql.Tx, msg *Message) (int, error) {
+	c.follow(msg)
+	return c.MessageDB.WriteTx(tx, msg)
+}
+
+func (c causedBy) WriteWithRetry(msg *Message, policy RetryPolicy) (int, error) {
+	c.follow(msg)
+	return c.MessageDB.WriteWithRetry(msg, policy)
+}
+
+func (c causedBy) WriteAndAwaitReply(cmd *Message, replyStream string, timeout time.Duration) (*Message, error) {
+	c.follow(cmd)
+	return c.MessageDB.WriteAndAwaitReply(cmd, replyStream, timeout)
+}
+
+func (c causedBy) ImportStream(streamName string, r io.Reader, opts ...ImportOption) (int, error) {
+	opts = append(opts, func(o *importOptions) {
+		o.prepare = func(msg *Message) { c.follow(msg) }
+	})
+	return c.MessageDB.ImportStream(streamName, r, opts...)
+}
+
+func (c causedBy) MigrateStream(src, dst string, transform func(*Message) *Message) (int, error) {
+	return c.MessageDB.MigrateStream(src, dst, func(msg *Message) *Message {
+		if transform != nil {
+			msg = transform(msg)
+		}
+		if msg != nil {
+			c.follow(msg)
+		}
+		return msg
+	})
+}
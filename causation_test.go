@@ -0,0 +1,131 @@
+package messagedb_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestCausedBy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cause := messagedb.NewMessage("account-1", "Deposited")
+	cause.Position = 4
+	cause.GlobalPosition = 12
+	cause.Metadata = &messagedb.Metadata{CorrelationStreamName: "transfer-2", ReplyStreamName: "reply-3"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "ledger-1", "Credited", sqlmock.AnyArg(),
+			[]uint8(`{"causationMessageGlobalPosition":12,"causationMessagePosition":4,"causationMessageStreamName":"account-1","correlationStreamName":"transfer-2","replyStreamName":"reply-3"}`), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "ledger-1", "Credited", sqlmock.AnyArg(),
+			[]uint8(`{"causationMessageGlobalPosition":0,"causationMessagePosition":0,"causationMessageStreamName":"other-1"}`), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+	mock.ExpectCommit()
+
+	m := messagedb.CausedBy(messagedb.New(db), cause)
+
+	if _, err := m.Write(messagedb.NewMessage("ledger-1", "Credited")); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	caused := messagedb.NewMessage("ledger-1", "Credited")
+	caused.Metadata = &messagedb.Metadata{CausationMessageStreamName: "other-1"}
+	if _, err := m.Write(caused); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestCausedByCoversEveryWrite(t *testing.T) {
+	causation := `"causationMessageGlobalPosition":12,"causationMessagePosition":4,"causationMessageStreamName":"account-1"`
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	var tests = []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		write  func(m messagedb.MessageDB) error
+	}{
+		{"WriteAndAwaitReply", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs("reply-1").
+				WillReturnRows(mock.NewRows(columns))
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WithArgs(sqlmock.AnyArg(), "ledger:command-1", "Credit", sqlmock.AnyArg(),
+					[]uint8(`{`+causation+`,"replyStreamName":"reply-1"}`), nil).
+				WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+			mock.ExpectCommit()
+			mock.ExpectQuery("get_stream_messages").
+				WithArgs("reply-1", 0, 1000).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "reply-1", "Credited", 0, 14, nil, []byte(`{"causationMessageStreamName":"ledger:command-1","causationMessagePosition":0}`), time.Now()))
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.WriteAndAwaitReply(messagedb.NewMessage("ledger:command-1", "Credit"), "reply-1", time.Second)
+			return err
+		}},
+		{"ImportStream", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WithArgs(sqlmock.AnyArg(), "ledger-1", "Credited", []uint8("null"), []uint8(`{`+causation+`}`), nil).
+				WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+			mock.ExpectCommit()
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.ImportStream("", strings.NewReader(`{"id":"a","streamName":"ledger-1","type":"Credited"}`))
+			return err
+		}},
+		{"MigrateStream", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("get_stream_messages").
+				WithArgs("ledger-1", 0, 1000).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "ledger-1", "Credited", 0, 13, nil, nil, time.Now()))
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WithArgs(sqlmock.AnyArg(), "ledger-2", "Credited", []uint8("null"), []uint8(`{`+causation+`}`), -1).
+				WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+			mock.ExpectCommit()
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.MigrateStream("ledger-1", "ledger-2", nil)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			cause := messagedb.NewMessage("account-1", "Deposited")
+			cause.Position = 4
+			cause.GlobalPosition = 12
+
+			tt.expect(mock)
+
+			if err := tt.write(messagedb.CausedBy(messagedb.New(db), cause)); err != nil {
+				t.Fatalf("unexpected error '%s' when writing", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
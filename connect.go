@@ -0,0 +1,100 @@
+package messagedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Connect opens a database whose connections all have their search_path set
+// to schema followed by public, so the message-db functions resolve without
+// being schema qualified.
+//
+// Running SET search_path once through db.Exec is not enough: it only applies
+// to the pooled connection that happened to run it, and every other
+// connection the pool opens, including replacements for connections that are
+// closed or recycled, starts with the server's default search_path. Connect
+// sets it on each physical connection as it is established instead.
+func Connect(driverName, dsn, schema string) (*sql.DB, error) {
+	if schema == "" {
+		return nil, ErrSchemaRequired
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	if err = db.Close(); err != nil {
+		return nil, err
+	}
+
+	var connector driver.Connector
+	if driverContext, ok := d.(driver.DriverContext); ok {
+		if connector, err = driverContext.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	} else {
+		connector = dsnConnector{dsn, d}
+	}
+
+	return sql.OpenDB(searchPathConnector{connector, setSearchPathSQL(schema)}), nil
+}
+
+// ErrSchemaRequired ...
+var ErrSchemaRequired = errors.New("missing schema")
+
+func setSearchPathSQL(schema string) string {
+	return fmt.Sprintf(`SET search_path TO "%s", public`, strings.ReplaceAll(schema, `"`, `""`))
+}
+
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type searchPathConnector struct {
+	driver.Connector
+	query string
+}
+
+func (c searchPathConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = execConn(ctx, conn, c.query); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(nil)
+	return err
+}
@@ -0,0 +1,38 @@
+package messagedb_test
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+)
+
+func TestConnect(t *testing.T) {
+	dsn := "connect"
+	mockDB, mock, err := sqlmock.NewWithDSN(dsn, sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectExec(`SET search_path TO "message_store", public`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	db, err := messagedb.Connect("sqlmock", dsn, "message_store")
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when connecting", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("unexpected error '%s' when pinging", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+
+	if _, err := messagedb.Connect("sqlmock", dsn, ""); err != messagedb.ErrSchemaRequired {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrSchemaRequired)
+	}
+}
@@ -0,0 +1,60 @@
+package messagedb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// CanonicalJSON marshals v to JSON with the keys of every object sorted, no
+// insignificant whitespace and no HTML escaping, so that equal values always
+// marshal to the same bytes whatever their Go types or key order. Numbers are
+// kept as they are written.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalizeJSON(b)
+}
+
+func canonicalizeJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ContentHash returns the hex encoded SHA-256 of the message's type and the
+// canonical JSON of its data, RawData if set and otherwise Data. Messages
+// with the same type and data have the same hash whatever their IDs, streams
+// or metadata, so it can be used to find duplicate messages.
+func (m *Message) ContentHash() (string, error) {
+	var data []byte
+	var err error
+	if len(m.RawData) > 0 {
+		data, err = canonicalizeJSON(m.RawData)
+	} else {
+		data, err = CanonicalJSON(m.Data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(m.Type))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,49 @@
+package messagedb_test
+
+import (
+	"testing"
+
+	"github.com/brycedarling/messagedb"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	b, err := messagedb.CanonicalJSON(struct {
+		Z string                 `json:"z"`
+		A map[string]interface{} `json:"a"`
+	}{"<tag>", map[string]interface{}{"y": 1.5, "b": []int{2, 1}}})
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when canonicalizing", err)
+	}
+
+	want := `{"a":{"b":[2,1],"y":1.5},"z":"<tag>"}`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(msg *messagedb.Message) string {
+		h, err := msg.ContentHash()
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when hashing", err)
+		}
+		return h
+	}
+
+	a := messagedb.NewMessage("account-1", "Deposited")
+	a.Data = map[string]interface{}{"amount": 10, "currency": "USD"}
+
+	b := messagedb.NewMessage("account-2", "Deposited")
+	b.RawData = []byte(`{ "currency": "USD", "amount": 10 }`)
+	b.Metadata = &messagedb.Metadata{SchemaVersion: 2}
+
+	c := messagedb.NewMessage("account-1", "Withdrawn")
+	c.Data = a.Data
+
+	if hash(a) != hash(b) {
+		t.Errorf("expected messages with the same type and data to have the same hash")
+	}
+	if hash(a) == hash(c) {
+		t.Errorf("expected messages with different types to have different hashes")
+	}
+}
@@ -0,0 +1,114 @@
+package messagedb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TxSubscriber handles a message within tx, the transaction its global
+// position is recorded in by a subscription made WithDedupTable.
+type TxSubscriber func(tx *sql.Tx, msg *Message) error
+
+// TxSubscribers ...
+type TxSubscribers map[string]TxSubscriber
+
+// WithDedupTable handles messages exactly once, even across restarts that
+// lose the subscription's position. Each message is handled by the
+// TxSubscriber for its type within a transaction that also records the
+// subscriber ID and the message's global position in tableName, so the
+// handler's changes and the record commit or roll back together. A message
+// already recorded is skipped without being handled. The transaction is bound
+// to the subscription's Context, so unsubscribing rolls back a message being
+// handled, to be handled again on restart. The subscribers replace those
+// passed to Subscribe, which may be nil.
+//
+// The table must exist, in the store's database, with a unique key on the
+// two columns:
+//
+//	CREATE TABLE projection_dedup (
+//		subscriber_id text NOT NULL,
+//		global_position bigint NOT NULL,
+//		PRIMARY KEY (subscriber_id, global_position)
+//	)
+//
+// tableName may be schema qualified. The subscription must come from a
+// MessageDB made by New.
+func WithDedupTable(tableName string, subscribers TxSubscribers) SubscriptionOption {
+	return func(s *subscription) {
+		s.dedupTable = tableName
+		s.txSubscribers = subscribers
+	}
+}
+
+// ErrDedupUnsupported ...
+var ErrDedupUnsupported = errors.New("dedup tables need a MessageDB made by New")
+
+// txBeginner is implemented by MessageDBs that can begin transactions on
+// their database.
+type txBeginner interface {
+	beginTx(ctx context.Context) (*sql.Tx, error)
+}
+
+func (m *messageDB) beginTx(ctx context.Context) (*sql.Tx, error) {
+	return m.db.BeginTx(ctx, m.txOptions)
+}
+
+// dedupSubscribers returns the subscription's TxSubscribers as Subscribers
+// that run them within a transaction recording each message in the dedup
+// table.
+func (s *subscription) dedupSubscribers() Subscribers {
+	query := fmt.Sprintf("INSERT INTO %s (subscriber_id, global_position) VALUES ($1, $2) ON CONFLICT DO NOTHING", quoteQualifiedName(s.dedupTable))
+	beginner := s.messageDB.(txBeginner)
+
+	subscribers := make(Subscribers, len(s.txSubscribers))
+	for messageType, fn := range s.txSubscribers {
+		subscribers[messageType] = func(msg *Message) error {
+			tx, err := beginner.beginTx(s.ctx)
+			if err != nil {
+				return contextError(s.ctx, err)
+			}
+			handled, err := s.handleOnce(tx, query, fn, msg)
+			if err != nil || !handled {
+				if rollbackErr := tx.Rollback(); err == nil {
+					err = contextError(s.ctx, rollbackErr)
+				}
+				return err
+			}
+			return contextError(s.ctx, tx.Commit())
+		}
+	}
+	return subscribers
+}
+
+// handleOnce records msg in the dedup table within tx and hands it to fn,
+// reporting false without calling fn if it was already recorded.
+func (s *subscription) handleOnce(tx *sql.Tx, query string, fn TxSubscriber, msg *Message) (bool, error) {
+	result, err := tx.Exec(query, s.subscriberID, msg.GlobalPosition)
+	if err != nil {
+		return false, contextError(s.ctx, err)
+	}
+	recorded, err := result.RowsAffected()
+	if err != nil {
+		return false, contextError(s.ctx, err)
+	}
+	if recorded == 0 {
+		s.updateStats(func(stats *SubscriptionStats) {
+			stats.DuplicatesSkipped++
+		})
+		return false, nil
+	}
+	return true, fn(tx, msg)
+}
+
+// quoteQualifiedName quotes each part of a possibly schema qualified name as
+// a Postgres identifier.
+func quoteQualifiedName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
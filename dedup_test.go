@@ -0,0 +1,138 @@
+package messagedb_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestSubscriptionWithDedupTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, nil, time.Now()))
+
+	insert := `INSERT INTO "projections"."dedup" \(subscriber_id, global_position\) VALUES \(\$1, \$2\) ON CONFLICT DO NOTHING`
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).
+		WithArgs(subscriberID, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE balances").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).
+		WithArgs(subscriberID, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	expectPositionFlush(mock, subscriberStreamName, 2)
+
+	m := messagedb.New(db)
+
+	var handled []int
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithDedupTable("projections.dedup", messagedb.TxSubscribers{
+			"Deposited": func(tx *sql.Tx, msg *messagedb.Message) error {
+				handled = append(handled, msg.GlobalPosition)
+				_, err := tx.Exec("UPDATE balances SET amount = amount + 1")
+				return err
+			},
+		}),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(nil) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []int{1}; fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Errorf("got %v handled, want %v", handled, want)
+	}
+	if skipped := sub.Stats().DuplicatesSkipped; skipped != 1 {
+		t.Errorf("got %d duplicates skipped, want 1", skipped)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithDedupTableUnsubscribe(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+	mock.ExpectBegin().WillDelayFor(5 * time.Second)
+
+	m := messagedb.New(db)
+
+	var handled bool
+	sub, err := m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithDedupTable("dedup", messagedb.TxSubscribers{
+			"Deposited": func(tx *sql.Tx, msg *messagedb.Message) error {
+				handled = true
+				return nil
+			},
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	time.AfterFunc(300*time.Millisecond, sub.Unsubscribe)
+	start := time.Now()
+	for err := range sub.Subscribe(nil) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s to stop, want the transaction cancelled by Unsubscribe", elapsed)
+	}
+	if handled {
+		t.Error("expected the message not to be handled once unsubscribed")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
@@ -1,10 +1,14 @@
 package messagedb
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func GetOrDefault(envVar string, defaultValue string) string {
@@ -46,3 +50,96 @@ func GetOrErr(envVar string) (string, error) {
 
 	return "", fmt.Errorf("Missing value for environment variable '%s'", envVar)
 }
+
+const (
+	// EnvMessageStoreHost is the name of the environment variable that specifies the host of the message-db server
+	EnvMessageStoreHost = "MESSAGE_STORE_HOST"
+
+	// EnvMessageStorePort is the name of the environment variable that specifies the port of the message-db server
+	EnvMessageStorePort = "MESSAGE_STORE_PORT"
+
+	// EnvMessageStoreUser is the name of the environment variable that specifies the user connecting to message-db
+	EnvMessageStoreUser = "MESSAGE_STORE_USER"
+
+	// EnvMessageStorePassword is the name of the environment variable that specifies the password of the user connecting to message-db
+	EnvMessageStorePassword = "MESSAGE_STORE_PASSWORD"
+
+	// EnvMessageStoreDb is the name of the environment variable that specifies the database used for message-db
+	EnvMessageStoreDb = "MESSAGE_STORE_DB"
+
+	// EnvMessageStoreSSLMode is the name of the environment variable that specifies the sslmode used to connect to message-db
+	EnvMessageStoreSSLMode = "MESSAGE_STORE_SSLMODE"
+)
+
+const (
+	defaultHost = "localhost"
+	defaultPort = 5432
+	defaultUser = "message_store"
+	defaultDb   = "message_store"
+)
+
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// DSNFromEnv builds a postgresql:// connection URL from the MESSAGE_STORE_*
+// environment variables, defaulting to the message_store user and database on
+// localhost:5432. IPv6 hosts are bracketed and the user and password escaped,
+// so either may hold characters such as @, : and /. The sslmode is left to the
+// driver unless it is set.
+func DSNFromEnv() (string, error) {
+	port, err := strconv.Atoi(GetOrDefault(EnvMessageStorePort, strconv.Itoa(defaultPort)))
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("Invalid port in environment variable '%s'", EnvMessageStorePort)
+	}
+
+	host := GetOrDefault(EnvMessageStoreHost, defaultHost)
+	if host == "" {
+		return "", fmt.Errorf("Missing value for environment variable '%s'", EnvMessageStoreHost)
+	}
+
+	db := GetOrDefault(EnvMessageStoreDb, defaultDb)
+	if db == "" {
+		return "", fmt.Errorf("Missing value for environment variable '%s'", EnvMessageStoreDb)
+	}
+
+	// An IPv6 host may be given with or without its brackets; JoinHostPort
+	// adds them back.
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	dsn := url.URL{
+		Scheme: "postgresql",
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:   "/" + db,
+	}
+
+	user := GetOrDefault(EnvMessageStoreUser, defaultUser)
+	if password, ok := os.LookupEnv(EnvMessageStorePassword); ok {
+		dsn.User = url.UserPassword(user, password)
+	} else {
+		dsn.User = url.User(user)
+	}
+
+	if sslMode, ok := os.LookupEnv(EnvMessageStoreSSLMode); ok {
+		if !sslModes[sslMode] {
+			return "", fmt.Errorf("Invalid sslmode '%s' in environment variable '%s'", sslMode, EnvMessageStoreSSLMode)
+		}
+		dsn.RawQuery = url.Values{"sslmode": {sslMode}}.Encode()
+	}
+
+	return dsn.String(), nil
+}
+
+// OpenFromEnv opens a database with the given driver using the DSN built by
+// DSNFromEnv.
+func OpenFromEnv(driver string) (*sql.DB, error) {
+	dsn, err := DSNFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open(driver, dsn)
+}
@@ -0,0 +1,138 @@
+package messagedb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// exportedMessage is the form of a message on one line of an export.
+type exportedMessage struct {
+	ID             string          `json:"id"`
+	StreamName     string          `json:"streamName"`
+	Type           string          `json:"type"`
+	Position       int             `json:"position"`
+	GlobalPosition int             `json:"globalPosition"`
+	Data           json.RawMessage `json:"data,omitempty"`
+	Metadata       *Metadata       `json:"metadata,omitempty"`
+	Time           time.Time       `json:"time"`
+}
+
+// ExportStream writes every message in the stream or category to w as
+// newline delimited JSON, one message per line, and returns how many it
+// wrote. Messages are written as they are read, a block at a time, so the
+// stream is never held in memory in full.
+func (m *messageDB) ExportStream(streamName string, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	count := 0
+	_, err := m.Replay(streamName, 0, func(msg *Message) error {
+		if err := enc.Encode(exportedMessage{
+			ID:             msg.ID,
+			StreamName:     msg.StreamName,
+			Type:           msg.Type,
+			Position:       msg.Position,
+			GlobalPosition: msg.GlobalPosition,
+			Data:           msg.RawData,
+			Metadata:       msg.Metadata,
+			Time:           msg.Time,
+		}); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// ImportOption ...
+type ImportOption func(*importOptions)
+
+type importOptions struct {
+	preserveIDs bool
+	// prepare, when set, is called with each message before it is written.
+	prepare func(*Message)
+}
+
+// WithPreservedIDs makes ImportStream write each message with the ID it was
+// exported with rather than a new one. Writing a message whose ID is already
+// in the store fails with ErrDuplicateMessageID.
+func WithPreservedIDs() ImportOption {
+	return func(o *importOptions) {
+		o.preserveIDs = true
+	}
+}
+
+// ImportStream writes the messages of an export read from r to streamName, in
+// order, keeping their types, data and metadata, and returns how many it
+// wrote. With an empty streamName each message is written to the stream it
+// was exported from. Messages are given new IDs unless WithPreservedIDs is
+// used. Positions and times are assigned by the store as the messages are
+// written.
+//
+// A line that is not an exported message stops the import with an
+// ErrMalformedLine.
+func (m *messageDB) ImportStream(streamName string, r io.Reader, opts ...ImportOption) (int, error) {
+	var o importOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	br := bufio.NewReader(r)
+	count := 0
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			var exported exportedMessage
+			if err := json.Unmarshal(b, &exported); err != nil {
+				return count, ErrMalformedLine{line, err}
+			}
+			msg := importedMessage(streamName, exported, o)
+			if o.prepare != nil {
+				o.prepare(msg)
+			}
+			if _, err := m.Write(msg); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+	}
+}
+
+func importedMessage(streamName string, exported exportedMessage, o importOptions) *Message {
+	if streamName == "" {
+		streamName = exported.StreamName
+	}
+	msg := NewMessage(streamName, exported.Type)
+	if o.preserveIDs {
+		msg.ID = exported.ID
+	}
+	if exported.Data != nil {
+		msg.RawData = exported.Data
+	}
+	msg.Metadata = exported.Metadata
+	return msg
+}
+
+// ErrMalformedLine ...
+type ErrMalformedLine struct {
+	Line int
+	Err  error
+}
+
+func (err ErrMalformedLine) Error() string {
+	return fmt.Sprintf("malformed message on line %d: %s", err.Line, err.Err)
+}
+
+// Unwrap ...
+func (err ErrMalformedLine) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,112 @@
+package messagedb_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+)
+
+func TestExportImportStream(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account-1"
+	written := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow("a", streamName, "Opened", 0, 1, nil, nil, written).
+			AddRow("b", streamName, "Deposited", 1, 2, []byte(`{"amount":10}`), []byte(`{"schemaVersion":2}`), written))
+
+	m := messagedb.New(db)
+
+	var buf bytes.Buffer
+	count, err := m.ExportStream(streamName, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when exporting", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d messages exported, want 2", count)
+	}
+
+	want := `{"id":"a","streamName":"account-1","type":"Opened","position":0,"globalPosition":1,"time":"2021-01-02T03:04:05Z"}
+{"id":"b","streamName":"account-1","type":"Deposited","position":1,"globalPosition":2,"data":{"amount":10},"metadata":{"schemaVersion":2},"time":"2021-01-02T03:04:05Z"}
+`
+	if buf.String() != want {
+		t.Errorf("got export\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	next := func(position string) *sqlmock.Rows {
+		return mock.NewRows([]string{"next_position"}).FromCSVString(position)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs("a", streamName, "Opened", []uint8("null"), []uint8("null"), nil).
+		WillReturnRows(next("0"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs("b", streamName, "Deposited", []uint8(`{"amount":10}`), []uint8(`{"schemaVersion":2}`), nil).
+		WillReturnRows(next("1"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "account-2", "Opened", []uint8("null"), []uint8("null"), nil).
+		WillReturnRows(next("0"))
+	mock.ExpectCommit()
+
+	if count, err = m.ImportStream("", strings.NewReader(want), messagedb.WithPreservedIDs()); err != nil {
+		t.Fatalf("unexpected error '%s' when importing", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d messages imported, want 2", count)
+	}
+
+	if _, err = m.ImportStream("account-2", strings.NewReader(strings.SplitAfter(want, "\n")[0])); err != nil {
+		t.Fatalf("unexpected error '%s' when importing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestImportStreamMalformedLine(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "account-1", "Opened", []uint8("null"), []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	export := `{"id":"a","streamName":"account-1","type":"Opened"}
+
+{"id":"b","streamName":"account-1",`
+
+	count, err := messagedb.New(db).ImportStream("", strings.NewReader(export))
+	if count != 1 {
+		t.Errorf("got %d messages imported, want 1", count)
+	}
+	if malformed, ok := err.(messagedb.ErrMalformedLine); !ok || malformed.Line != 3 {
+		t.Errorf("got %v, want malformed line 3", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
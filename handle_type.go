@@ -0,0 +1,48 @@
+package messagedb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// HandleType registers a Subscriber for msgType that decodes the message data
+// into a T before calling fn. A message whose data cannot be decoded stops the
+// subscription with an ErrDecode.
+func HandleType[T any](subscribers Subscribers, msgType string, fn func(*Message, T) error) {
+	subscribers[msgType] = func(msg *Message) error {
+		var data T
+		if err := decodeData(msg, &data); err != nil {
+			return err
+		}
+		return fn(msg, data)
+	}
+}
+
+func decodeData(msg *Message, v interface{}) error {
+	b := msg.RawData
+	if len(b) == 0 {
+		var err error
+		if b, err = json.Marshal(msg.Data); err != nil {
+			return ErrDecode{msg, err}
+		}
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrDecode{msg, err}
+	}
+	return nil
+}
+
+// ErrDecode ...
+type ErrDecode struct {
+	Message *Message
+	Err     error
+}
+
+func (err ErrDecode) Error() string {
+	return fmt.Sprintf("decoding '%s' message %s at global position %d: %s", err.Message.Type, err.Message.ID, err.Message.GlobalPosition, err.Err)
+}
+
+// Unwrap ...
+func (err ErrDecode) Unwrap() error {
+	return err.Err
+}
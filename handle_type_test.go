@@ -0,0 +1,128 @@
+package messagedb_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+type deposited struct {
+	AccountID string `json:"accountId"`
+	Amount    int    `json:"amount"`
+}
+
+func TestHandleType(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, []byte(`{"accountId":"1","amount":10}`), nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got deposited
+	subscribers := messagedb.Subscribers{}
+	messagedb.HandleType(subscribers, "Deposited", func(msg *messagedb.Message, d deposited) error {
+		got = d
+		return nil
+	})
+
+	for err := range sub.Subscribe(subscribers) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := (deposited{AccountID: "1", Amount: 10}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestHandleTypeDecodeError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, []byte(`{"accountId":"1","amount":"ten"}`), nil, time.Now()))
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	called := false
+	subscribers := messagedb.Subscribers{}
+	messagedb.HandleType(subscribers, "Deposited", func(msg *messagedb.Message, d deposited) error {
+		called = true
+		return nil
+	})
+
+	var errs []error
+	for err := range sub.Subscribe(subscribers) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	var decodeErr messagedb.ErrDecode
+	if !errors.As(errs[0], &decodeErr) {
+		t.Errorf("got error '%s', want ErrDecode", errs[0])
+	} else if decodeErr.Message.GlobalPosition != 1 {
+		t.Errorf("got global position %d, want 1", decodeErr.Message.GlobalPosition)
+	}
+	if called {
+		t.Error("handler was called for a message that failed to decode")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
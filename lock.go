@@ -0,0 +1,67 @@
+package messagedb
+
+import (
+	"context"
+	"errors"
+)
+
+// The first keys of the two key advisory locks taken on categories and
+// subscribers. message-db's own write locks use single bigint keys, which
+// Postgres keeps apart from two key locks, so holding a category lock never
+// blocks writes to the category.
+const (
+	categoryLockNamespace   int = 0x6d646263
+	subscriberLockNamespace int = 0x6d646273
+)
+
+// The queries run to take and release category and subscriber locks.
+const (
+	TryAdvisoryLockSQL string = "SELECT pg_try_advisory_lock($1, hashtext($2))"
+	AdvisoryUnlockSQL  string = "SELECT pg_advisory_unlock($1, hashtext($2))"
+)
+
+// TryLockCategory tries to take a Postgres advisory lock on category without
+// waiting, so that only one process at a time handles it. The lock is held on
+// a connection taken from the pool until unlock is called, and is released by
+// the server if that connection is lost. When the lock is held elsewhere ok is
+// false and unlock is nil.
+func (m *messageDB) TryLockCategory(category string) (unlock func(), ok bool, err error) {
+	if category == "" {
+		return nil, false, ErrCategoryRequired
+	}
+	return m.tryLock(categoryLockNamespace, category)
+}
+
+// TryLockSubscriber is TryLockCategory for a subscriber ID, so that only one
+// instance of a subscriber runs at a time.
+func (m *messageDB) TryLockSubscriber(subscriberID string) (unlock func(), ok bool, err error) {
+	if subscriberID == "" {
+		return nil, false, ErrSubscriberIDRequired
+	}
+	return m.tryLock(subscriberLockNamespace, subscriberID)
+}
+
+func (m *messageDB) tryLock(namespace int, key string) (unlock func(), ok bool, err error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = conn.QueryRowContext(ctx, TryAdvisoryLockSQL, namespace, key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+
+	unlock = func() {
+		conn.ExecContext(ctx, AdvisoryUnlockSQL, namespace, key)
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+// ErrCategoryLocked ...
+var ErrCategoryLocked = errors.New("category is locked by another subscriber")
+
+// ErrSubscriberAlreadyActive ...
+var ErrSubscriberAlreadyActive = errors.New("subscriber is already active in another process")
@@ -0,0 +1,145 @@
+package messagedb_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+)
+
+func TestTryLockCategory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	category := "account"
+
+	mock.ExpectQuery("pg_try_advisory_lock").
+		WithArgs(sqlmock.AnyArg(), category).
+		WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	mock.ExpectExec("pg_advisory_unlock").
+		WithArgs(sqlmock.AnyArg(), category).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("pg_try_advisory_lock").
+		WithArgs(sqlmock.AnyArg(), category).
+		WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+
+	m := messagedb.New(db)
+
+	unlock, ok, err := m.TryLockCategory(category)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when locking category", err)
+	}
+	if !ok {
+		t.Fatal("expected to lock category")
+	}
+	unlock()
+
+	unlock, ok, err = m.TryLockCategory(category)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when locking category", err)
+	}
+	if ok || unlock != nil {
+		t.Error("expected category to be locked elsewhere")
+	}
+
+	if _, _, err := m.TryLockCategory(""); err != messagedb.ErrCategoryRequired {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrCategoryRequired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithExclusiveLock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("pg_try_advisory_lock").
+		WithArgs(sqlmock.AnyArg(), "account").
+		WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription("account", "test", messagedb.WithExclusiveLock())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var errs []error
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 1 || !errors.Is(errs[0], messagedb.ErrCategoryLocked) {
+		t.Errorf("got errors %v, want [%s]", errs, messagedb.ErrCategoryLocked)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithSingleInstance(t *testing.T) {
+	var tests = []struct {
+		name   string
+		expect func(sqlmock.Sqlmock)
+		err    error
+	}{
+		{"already active", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("pg_try_advisory_lock").
+				WithArgs(sqlmock.AnyArg(), "test").
+				WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+		}, messagedb.ErrSubscriberAlreadyActive},
+		{"category locked", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("pg_try_advisory_lock").
+				WithArgs(sqlmock.AnyArg(), "test").
+				WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+			mock.ExpectQuery("pg_try_advisory_lock").
+				WithArgs(sqlmock.AnyArg(), "account").
+				WillReturnRows(mock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+			mock.ExpectExec("pg_advisory_unlock").
+				WithArgs(sqlmock.AnyArg(), "test").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}, messagedb.ErrCategoryLocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tt.expect(mock)
+
+			m := messagedb.New(db)
+
+			sub, err := m.CreateSubscription("account", "test", messagedb.WithSingleInstance(), messagedb.WithExclusiveLock())
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when creating subscription", err)
+			}
+
+			var errs []error
+			for err := range sub.Subscribe(messagedb.Subscribers{}) {
+				errs = append(errs, err)
+			}
+
+			if len(errs) != 1 || !errors.Is(errs[0], tt.err) {
+				t.Errorf("got errors %v, want [%s]", errs, tt.err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
@@ -9,13 +9,30 @@ import (
 // Messages ...
 type Messages []*Message
 
+// GroupByStream partitions msgs by stream name, keeping the messages of each
+// stream in the order they appear in msgs.
+func (msgs Messages) GroupByStream() map[string]Messages {
+	streams := make(map[string]Messages)
+	for _, msg := range msgs {
+		streams[msg.StreamName] = append(streams[msg.StreamName], msg)
+	}
+	return streams
+}
+
 // Message ...
 type Message struct {
-	ID              string
-	StreamName      string
-	Type            string
-	Data            map[string]interface{}
-	Metadata        map[string]interface{}
+	ID         string
+	StreamName string
+	Type       string
+	Data       map[string]interface{}
+	// RawData, when set, is written as the message data in place of Data.
+	// message-db stores data as jsonb, so RawData must be valid JSON; encode
+	// binary payloads such as protobuf or msgpack as a JSON string, for example
+	// by marshaling the []byte, which base64 encodes it. Messages that are read
+	// carry their data as written in RawData, and in Data too when it is a
+	// JSON object.
+	RawData         []byte
+	Metadata        *Metadata
 	ExpectedVersion *int
 	Position        int
 	GlobalPosition  int
@@ -30,3 +47,79 @@ func NewMessage(streamName, messageType string) *Message {
 		Type:       messageType,
 	}
 }
+
+// NewMessageValidated is NewMessage, returning an error in place of a message
+// whose stream name is not well formed, per ValidateStreamName, or whose type
+// is empty, rather than leaving Write to reject it.
+func NewMessageValidated(streamName, messageType string) (*Message, error) {
+	if err := ValidateStreamName(streamName); err != nil {
+		return nil, err
+	}
+	if messageType == "" {
+		return nil, ErrTypeRequired
+	}
+	return NewMessage(streamName, messageType), nil
+}
+
+// CorrelationStreamName ...
+func (m *Message) CorrelationStreamName() string {
+	if m.Metadata == nil {
+		return ""
+	}
+	return m.Metadata.CorrelationStreamName
+}
+
+// Correlate sets the correlation stream name of m, the correlationStreamName
+// metadata that correlated reads and subscriptions, WithCorrelation, select
+// messages by the category of. It returns an error, leaving m unchanged, if
+// correlationStreamName is not well formed per ValidateStreamName.
+func (m *Message) Correlate(correlationStreamName string) error {
+	if err := ValidateStreamName(correlationStreamName); err != nil {
+		return err
+	}
+	if m.Metadata == nil {
+		m.Metadata = &Metadata{}
+	}
+	m.Metadata.CorrelationStreamName = correlationStreamName
+	return nil
+}
+
+// CausationMessageStreamName ...
+func (m *Message) CausationMessageStreamName() string {
+	if m.Metadata == nil {
+		return ""
+	}
+	return m.Metadata.CausationMessageStreamName
+}
+
+// CausationMessagePosition ...
+func (m *Message) CausationMessagePosition() int {
+	if m.Metadata == nil {
+		return 0
+	}
+	return m.Metadata.CausationMessagePosition
+}
+
+// CausationMessageGlobalPosition ...
+func (m *Message) CausationMessageGlobalPosition() int {
+	if m.Metadata == nil {
+		return 0
+	}
+	return m.Metadata.CausationMessageGlobalPosition
+}
+
+// ReplyStreamName ...
+func (m *Message) ReplyStreamName() string {
+	if m.Metadata == nil {
+		return ""
+	}
+	return m.Metadata.ReplyStreamName
+}
+
+// SchemaVersion ...
+func (m *Message) SchemaVersion() int {
+	if m.Metadata == nil {
+		return 0
+	}
+	return m.Metadata.SchemaVersion
+}
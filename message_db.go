@@ -1,97 +1,953 @@
 package messagedb
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // MessageDB ...
+//
+// A MessageDB is safe for concurrent use by multiple goroutines, including
+// writes made while its subscriptions are polling. Subscriptions share the
+// underlying *sql.DB connection pool with other callers.
 type MessageDB interface {
-	CreateSubscription(streamName, subscriberID string) (Subscription, error)
+	Categories(after string, limit int) ([]string, error)
+	CreateSubscription(streamName, subscriberID string, opts ...SubscriptionOption) (Subscription, error)
+	ExportStream(streamName string, w io.Writer) (int, error)
+	ImportStream(streamName string, r io.Reader, opts ...ImportOption) (int, error)
+	MaxGlobalPosition() (int, error)
+	MessageCount(streamName string) (int, error)
+	ListSubscribers() ([]SubscriberStatus, error)
+	MigrateStream(src, dst string, transform func(*Message) *Message) (int, error)
+	Peek(streamName, subscriberID string, n int) (Messages, error)
 	Read(streamName string, position, batchSize int) (Messages, error)
+	ReadInto(streamName string, position, batchSize int, msg *Message, fn func(*Message) error) error
+	ReadCategory(category string, position, batchSize int, filter CategoryFilter) (Messages, error)
+	ReadCategoryFromGlobal(category string, afterGlobalPosition, batchSize int) (Messages, error)
+	ReadCategoryForCardinal(category, cardinalID string, position, batchSize int) (Messages, int, error)
 	ReadAll(streamName string) (Messages, error)
+	ReadAllContext(ctx context.Context, streamName string) (Messages, error)
+	ReadByID(streamName, id string) (*Message, error)
 	ReadLast(streamName string) (*Message, error)
+	ReadPage(streamName string, from, size int) (msgs Messages, next int, err error)
+	ReadLastCategory(category string) (*Message, error)
+	ReadSince(streamName string, since time.Time) (Messages, error)
+	ReadStream(streamName string, position, batchSize int, condition string) (Messages, error)
+	ReadUpTo(streamName string, version int) (Messages, error)
+	Replay(streamName string, from int, handler func(*Message) error) (lastPosition int, err error)
+	ResetSubscriber(subscriberID string) error
+	ResetSubscribers(subscriberIDs []string) error
+	Stream(streamName string, from int) iter.Seq2[*Message, error]
+	SubscribeChan(streamName, subscriberID string, opts ...SubscriptionOption) (<-chan *Message, <-chan error, func())
+	TryLockCategory(category string) (unlock func(), ok bool, err error)
+	TryLockSubscriber(subscriberID string) (unlock func(), ok bool, err error)
 	Write(*Message) (int, error)
+	WriteContext(ctx context.Context, msg *Message) (int, error)
+	WriteIf(streamName string, fold func(Messages) (ok bool, expectedVersion int), msg *Message) (int, error)
+	WriteAndAwaitReply(cmd *Message, replyStream string, timeout time.Duration) (*Message, error)
+	WriteMany(streamName string, expectedVersion *int, msgs Messages) (int, error)
+	WriteSequence(streamName string, startVersion int, msgs Messages) (int, error)
+	WriteTx(tx *sql.Tx, msg *Message) (int, error)
+	WriteWithRetry(*Message, RetryPolicy) (int, error)
 }
 
 // New ...
-func New(db *sql.DB) MessageDB {
-	return &messageDB{db}
+func New(db *sql.DB, opts ...Option) MessageDB {
+	m := &messageDB{
+		db:              db,
+		readDB:          db,
+		blockSize:       defaultBlockSize,
+		maxPayloadBytes: DefaultMaxPayloadBytes,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// NewReadWrite returns a MessageDB that writes to write, the primary, and
+// reads from read, such as a replica. Reads, including those of
+// subscriptions, the iterators and WriteAndAwaitReply, may then lag behind
+// writes by however far the replica has yet to catch up: a subscription can
+// poll for a while before seeing a message that was just written. Reads that
+// a write depends on are made on the primary instead: WriteIf's and those of
+// the PositionStore subscriptions use by default, as well as the advisory
+// locks.
+func NewReadWrite(write, read *sql.DB, opts ...Option) MessageDB {
+	m := New(write, opts...).(*messageDB)
+	m.readDB = read
+	return m
+}
+
+// primary returns m reading from its primary, for reads that a write depends
+// on and so must not be stale.
+func (m *messageDB) primary() *messageDB {
+	if m.readDB == m.db {
+		return m
+	}
+	p := *m
+	p.readDB = m.db
+	return &p
+}
+
+// Option configures a MessageDB made by New or NewReadWrite. Settings are
+// added as Options rather than as constructor parameters or variants, so
+// New(db) keeps its zero-config defaults and existing calls keep compiling
+// as settings are added. Options apply in order, so a later one overrides an
+// earlier one setting the same thing.
+type Option func(*messageDB)
+
+// WithBlockSize sets how many messages ReadAll, ReadSince and Replay read per
+// query, 1000 by default. Smaller blocks bound memory use when messages are
+// large, larger blocks save round trips. Sizes less than 1 are ignored.
+func WithBlockSize(size int) Option {
+	return func(m *messageDB) {
+		if size > 0 {
+			m.blockSize = size
+		}
+	}
+}
+
+// WithCanonicalJSON makes Write send data and metadata as CanonicalJSON, so
+// the same payload is always sent as the same bytes, RawData included. jsonb
+// keeps its own key order, so messages that are read back must be
+// canonicalized again before their bytes are compared, hashed or verified.
+func WithCanonicalJSON() Option {
+	return func(m *messageDB) {
+		m.canonicalJSON = true
+	}
+}
+
+// WithClock sets the function the store calls for the current time, time.Now
+// by default. It decides when WriteAndAwaitReply's timeout has passed and,
+// for the store's subscriptions, when WithPositionFlushInterval is due, so
+// tests can pass a fake clock to reach either without waiting for it.
+// WriteAndAwaitReply still sleeps between polls in real time, and never polls
+// for longer than its timeout, so a clock that stands still cannot keep it
+// waiting forever.
+func WithClock(now func() time.Time) Option {
+	return func(m *messageDB) {
+		if now != nil {
+			m.now = now
+		}
+	}
+}
+
+// DefaultMaxPayloadBytes is the largest data or metadata Write sends by
+// default, the most Postgres stores in a single jsonb value.
+const DefaultMaxPayloadBytes int = 1<<28 - 1
+
+// WithMaxPayloadBytes sets the largest data or metadata, in bytes of JSON,
+// that Write sends, failing with ErrPayloadTooLarge for larger messages rather
+// than leaving Postgres to reject them. Sizes less than 1 are ignored.
+func WithMaxPayloadBytes(max int) Option {
+	return func(m *messageDB) {
+		if max > 0 {
+			m.maxPayloadBytes = max
+		}
+	}
+}
+
+// WithIsolationLevel sets the isolation level of the transactions Write and
+// WriteMany begin, the database's default, usually read committed, otherwise.
+// message-db's write_message expects read committed: it serializes writers to
+// a stream with an advisory lock and then reads the stream's version, which
+// under repeatable read or serializable comes from a snapshot taken before the
+// lock was granted. Concurrent writes to a stream can then fail with
+// serialization errors that need retrying, even when they expect no version.
+// WriteTx uses the level of the caller's transaction.
+func WithIsolationLevel(level sql.IsolationLevel) Option {
+	return func(m *messageDB) {
+		m.txOptions = &sql.TxOptions{Isolation: level}
+	}
+}
+
+// WithMetadataFromContext sets the extractor WriteContext calls to find
+// metadata, such as a trace ID or tenant, in the context of each write. The
+// keys it returns are metadata keys, conventional ones like
+// correlationStreamName filling in the matching Metadata field and any others
+// kept in Extra, and they never replace metadata the message already has.
+func WithMetadataFromContext(extract func(ctx context.Context) map[string]interface{}) Option {
+	return func(m *messageDB) {
+		m.metadataFromContext = extract
+	}
+}
+
+// WithSchemaVersion registers version as the current schema version of
+// messages of msgType. Writes stamp it into the schemaVersion metadata of
+// those messages that do not carry a version of their own, and subscribers
+// registered under VersionedType can then handle each version separately.
+func WithSchemaVersion(msgType string, version int) Option {
+	return func(m *messageDB) {
+		if m.schemaVersions == nil {
+			m.schemaVersions = make(map[string]int)
+		}
+		m.schemaVersions[msgType] = version
+	}
+}
+
+// WithReadBudget bounds how long ReadAll, ReadAllContext and Replay may run,
+// so that an unexpectedly large stream or category cannot hold up a caller.
+// One that runs out of budget stops with an ErrReadBudgetExceeded saying how
+// far it got. Budgets less than 1 are ignored.
+func WithReadBudget(d time.Duration) Option {
+	return func(m *messageDB) {
+		if d > 0 {
+			m.readBudget = d
+		}
+	}
+}
+
+// WriteFunc writes msg, returning the position it was written at.
+type WriteFunc func(ctx context.Context, msg *Message) (int, error)
+
+// WithWriteInterceptor wraps every write of a single message, by Write,
+// WriteContext, WriteTx and the methods built on them, in interceptor, for
+// behavior common to all writes such as audit logging, enrichment or
+// validation. An interceptor can inspect or change the message before calling
+// next, see the position or error next returns, or return an error without
+// calling next so that the message is not written. Interceptors registered
+// first are outermost. Subscriptions write their positions through them too,
+// as messages of type PositionMessageType. WriteMany, which writes its
+// messages as one batch, does not run them.
+func WithWriteInterceptor(interceptor func(next WriteFunc) WriteFunc) Option {
+	return func(m *messageDB) {
+		m.writeInterceptors = append(m.writeInterceptors, interceptor)
+	}
+}
+
+// WithMaxConcurrentPolls lets at most n of the store's subscriptions read a
+// batch at once, so that many subscriptions ticking together cannot take
+// every connection in the *sql.DB's pool and time out the store's other
+// queries. A subscription whose turn has not come waits for another to
+// finish its read; SubscriptionStats.PollWait tells how long. A turn ends
+// once the batch has been read, before its messages are handled. Sizes less
+// than 1 are ignored.
+func WithMaxConcurrentPolls(n int) Option {
+	return func(m *messageDB) {
+		if n > 0 {
+			m.pollSlots = make(chan struct{}, n)
+		}
+	}
 }
 
 type messageDB struct {
-	db *sql.DB
+	db              *sql.DB
+	readDB          *sql.DB
+	blockSize       int
+	canonicalJSON   bool
+	txOptions       *sql.TxOptions
+	maxPayloadBytes int
+	readBudget      time.Duration
+	schemaVersions  map[string]int
+	now             func() time.Time
+
+	metadataFromContext func(context.Context) map[string]interface{}
+	writeInterceptors   []func(WriteFunc) WriteFunc
+	// pollSlots holds a value for each subscription reading a batch.
+	pollSlots chan struct{}
 }
 
 var _ MessageDB = (*messageDB)(nil)
 
-func (m *messageDB) CreateSubscription(streamName, subscriberID string) (Subscription, error) {
-	return newSubscription(m, streamName, subscriberID)
+func (m *messageDB) CreateSubscription(streamName, subscriberID string, opts ...SubscriptionOption) (Subscription, error) {
+	return newSubscription(m, streamName, subscriberID, opts...)
+}
+
+// CategoriesSQL is the query run by Categories.
+const CategoriesSQL string = "SELECT DISTINCT category(stream_name) AS category FROM messages WHERE category(stream_name) > $1 ORDER BY category LIMIT $2"
+
+// Categories returns up to limit of the distinct categories in the store,
+// in order, starting after the category named after. Pass the last category
+// returned as after to read the next page, or "" to start from the beginning.
+// A limit less than 1 returns every category.
+//
+// message-db has no index on categories, so every call scans the messages
+// table, which can be expensive on large stores.
+func (m *messageDB) Categories(after string, limit int) (categories []string, err error) {
+	var max interface{}
+	if limit > 0 {
+		max = limit
+	}
+
+	rows, err := m.readDB.Query(CategoriesSQL, after, max)
+	if err != nil {
+		return categories, m.queryError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		if err = rows.Scan(&category); err != nil {
+			return categories, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// MaxGlobalPositionSQL is the query run by MaxGlobalPosition.
+const MaxGlobalPositionSQL string = "SELECT max(global_position) FROM messages"
+
+// MaxGlobalPosition returns the global position of the newest message in the
+// store, or 0 if it has none.
+//
+// The maximum is read from the end of the index on global_position rather
+// than by scanning every message, but it is still a query per call, so poll it
+// at monitoring intervals rather than per message.
+func (m *messageDB) MaxGlobalPosition() (int, error) {
+	var position sql.NullInt64
+	if err := m.readDB.QueryRow(MaxGlobalPositionSQL).Scan(&position); err != nil {
+		return 0, m.queryError(err)
+	}
+	return int(position.Int64), nil
 }
 
+// The queries run by MessageCount.
 const (
-	categoryMessagesSQL string = "SELECT * FROM get_category_messages($1, $2, $3)"
-	streamMessagesSQL   string = "SELECT * FROM get_stream_messages($1, $2, $3)"
+	StreamVersionSQL        string = "SELECT stream_version($1)"
+	CategoryMessageCountSQL string = "SELECT count(*) FROM messages WHERE category(stream_name) = $1"
 )
 
+// MessageCount returns the number of messages in the stream or category, or 0
+// if it has none.
+//
+// An entity stream's count comes from its version, a single indexed lookup. A
+// category has no such version, so its messages are counted, which scans
+// every message in the category.
+func (m *messageDB) MessageCount(streamName string) (int, error) {
+	if !isEntityStream(streamName) {
+		var count int
+		err := m.readDB.QueryRow(CategoryMessageCountSQL, streamName).Scan(&count)
+		return count, m.queryError(err)
+	}
+
+	var version sql.NullInt64
+	if err := m.readDB.QueryRow(StreamVersionSQL, streamName).Scan(&version); err != nil {
+		return 0, m.queryError(err)
+	}
+	if !version.Valid {
+		return 0, nil
+	}
+	return int(version.Int64) + 1, nil
+}
+
+// The queries run by Read for categories and entity streams.
+const (
+	CategoryMessagesSQL string = "SELECT * FROM get_category_messages($1, $2, $3)"
+	StreamMessagesSQL   string = "SELECT * FROM get_stream_messages($1, $2, $3)"
+)
+
+// The queries run by ReadCategory and ReadStream.
+const (
+	FilteredCategoryMessagesSQL string = "SELECT * FROM get_category_messages($1, $2, $3, $4, $5, $6, $7)"
+	FilteredStreamMessagesSQL   string = "SELECT * FROM get_stream_messages($1, $2, $3, $4)"
+)
+
+// CategoryFilter narrows a read of a category to some of its messages. The
+// zero value reads every message.
+type CategoryFilter struct {
+	// Correlation, when set, is a category, and only messages whose
+	// correlation stream name, set by Message.Correlate, is in it are read.
+	Correlation string
+	// ConsumerGroupSize, when greater than 0, splits the streams of the
+	// category between that many consumers, and only the streams of
+	// ConsumerGroupMember, from 0 to ConsumerGroupSize-1, are read. message-db
+	// assigns each stream to a member by a hash of its cardinal id.
+	ConsumerGroupMember int
+	ConsumerGroupSize   int
+	// Condition, when set, is an SQL condition on the columns of the
+	// messages table that read messages must meet, such as
+	// "type IN ('Deposited', 'Withdrawn')". See ReadStream.
+	Condition string
+}
+
+func (f CategoryFilter) validate() error {
+	if isEntityStream(f.Correlation) {
+		return ErrInvalidCategory
+	}
+	if f.ConsumerGroupSize < 0 || f.ConsumerGroupMember < 0 ||
+		(f.ConsumerGroupSize > 0 && f.ConsumerGroupMember >= f.ConsumerGroupSize) ||
+		(f.ConsumerGroupSize == 0 && f.ConsumerGroupMember != 0) {
+		return ErrInvalidConsumerGroup
+	}
+	return validateCondition(f.Condition)
+}
+
+// args returns the correlation, consumer group and condition arguments of
+// get_category_messages, NULL for those the filter leaves unset.
+func (f CategoryFilter) args() (correlation, member, size, condition interface{}) {
+	if f.Correlation != "" {
+		correlation = f.Correlation
+	}
+	if f.ConsumerGroupSize > 0 {
+		member, size = f.ConsumerGroupMember, f.ConsumerGroupSize
+	}
+	return correlation, member, size, nullableCondition(f.Condition)
+}
+
+// ReadCategory reads a batch of up to batchSize messages from category
+// starting at global position position, keeping only those that filter
+// selects. The filtering is done by message-db, so a full batch does not mean
+// messages were skipped.
+func (m *messageDB) ReadCategory(category string, position, batchSize int, filter CategoryFilter) (msgs Messages, err error) {
+	if isEntityStream(category) {
+		return nil, ErrInvalidCategory
+	}
+	if err = filter.validate(); err != nil {
+		return nil, err
+	}
+
+	correlation, member, size, condition := filter.args()
+	return m.queryMessages(FilteredCategoryMessagesSQL, category, position, batchSize, correlation, member, size, condition)
+}
+
+// ReadCategoryFromGlobal reads a batch of up to batchSize messages from
+// category whose global positions are after afterGlobalPosition, in global
+// position order, so a projection can resume from the global position of the
+// last message it handled. Global positions are the store-wide sequence every
+// message is numbered in, not positions within a stream, and a category's are
+// usually not contiguous. Pass 0 to read from the beginning.
+func (m *messageDB) ReadCategoryFromGlobal(category string, afterGlobalPosition, batchSize int) (Messages, error) {
+	if isEntityStream(category) {
+		return nil, ErrInvalidCategory
+	}
+	return m.queryMessages(CategoryMessagesSQL, category, afterGlobalPosition+1, batchSize)
+}
+
+// ReadStream reads a batch of up to batchSize messages from the entity
+// stream starting at position position, keeping only those that meet the SQL
+// condition, such as "type = 'Deposited'", on the columns of the messages
+// table. An empty condition keeps every message.
+//
+// message-db only accepts a condition when the message_store.sql_condition
+// setting is on, for the session or the database, and otherwise fails the
+// read. The condition is added to message-db's query as it is, so it must
+// never be built from untrusted input: it runs with the privileges of the
+// reading role and can read, or with enough privileges change, anything that
+// role can. Conditions containing a semicolon or an SQL comment are rejected
+// with ErrInvalidCondition, which guards against mistakes, not attacks.
+func (m *messageDB) ReadStream(streamName string, position, batchSize int, condition string) (Messages, error) {
+	if !isEntityStream(streamName) {
+		return nil, ErrEntityStreamRequired
+	}
+	if err := validateCondition(condition); err != nil {
+		return nil, err
+	}
+	return m.queryMessages(FilteredStreamMessagesSQL, streamName, position, batchSize, nullableCondition(condition))
+}
+
+// queryMessages runs query and returns the messages it selects.
+func (m *messageDB) queryMessages(query string, args ...interface{}) (msgs Messages, err error) {
+	var d rowDecoder
+	err = m.queryRows(context.Background(), func(rows *sql.Rows) error {
+		msg, err := d.decode(rows)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		return nil
+	}, query, args...)
+	return msgs, err
+}
+
+func validateCondition(condition string) error {
+	if strings.Contains(condition, ";") || strings.Contains(condition, "--") || strings.Contains(condition, "/*") {
+		return ErrInvalidCondition
+	}
+	return nil
+}
+
+// nullableCondition returns condition as an argument, NULL when it is empty.
+func nullableCondition(condition string) interface{} {
+	if condition == "" {
+		return nil
+	}
+	return condition
+}
+
+// ErrInvalidCondition ...
+var ErrInvalidCondition = errors.New("condition must not contain a semicolon or a comment")
+
+// ErrInvalidConsumerGroup ...
+var ErrInvalidConsumerGroup = errors.New("consumer group member must be from 0 to one less than the group size")
+
+// Read reads a batch of up to blockSize messages from streamName starting at
+// position, which for an entity stream is a stream position and for a
+// category a global position. ReadCategoryFromGlobal reads a category with
+// its coordinates explicit.
 func (m *messageDB) Read(streamName string, position int, blockSize int) (msgs Messages, err error) {
+	return m.readContext(context.Background(), streamName, position, blockSize)
+}
+
+func (m *messageDB) readContext(ctx context.Context, streamName string, position int, blockSize int) (msgs Messages, err error) {
+	err = m.readEach(ctx, streamName, position, blockSize, func(msg *Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// readEach calls fn with each message as it is scanned rather than collecting
+// them, stopping with fn's error if it returns one. The query's connection is
+// held until every message has been handed to fn.
+func (m *messageDB) readEach(ctx context.Context, streamName string, position int, blockSize int, fn func(*Message) error) error {
+	var d rowDecoder
+	return m.readRows(ctx, streamName, position, blockSize, func(rows *sql.Rows) error {
+		msg, err := d.decode(rows)
+		if err != nil {
+			return err
+		}
+		return fn(msg)
+	})
+}
+
+// ReadInto reads like Read but scans every message into msg, calling fn with
+// it after each, rather than allocating a new Message per row. msg's Data map
+// and RawData buffer are reused from one message to the next, so fn must copy
+// anything it keeps once it returns.
+func (m *messageDB) ReadInto(streamName string, position, batchSize int, msg *Message, fn func(*Message) error) error {
+	return m.readRows(context.Background(), streamName, position, batchSize, func(rows *sql.Rows) error {
+		if err := scanMessageInto(rows, msg); err != nil {
+			return err
+		}
+		return fn(msg)
+	})
+}
+
+func (m *messageDB) readRows(ctx context.Context, streamName string, position int, blockSize int, fn func(*sql.Rows) error) error {
 	var query string
-	if strings.Contains(streamName, "-") {
-		// Entity streams have a dash
-		query = streamMessagesSQL
+	if isEntityStream(streamName) {
+		query = StreamMessagesSQL
 	} else {
-		// Category streams do not have a dash
-		query = categoryMessagesSQL
+		query = CategoryMessagesSQL
 	}
+	return m.queryRows(ctx, fn, query, streamName, position, blockSize)
+}
 
-	rows, err := m.db.Query(query, streamName, position, blockSize)
+// queryRows runs query and calls fn with each row, stopping with fn's error
+// if it returns one. An error that ends the rows early, such as a cancelled
+// context or a dropped connection, is returned rather than taken for the end
+// of the results.
+func (m *messageDB) queryRows(ctx context.Context, fn func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := m.readDB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return msgs, err
+		return contextError(ctx, m.queryError(err))
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		msg, err := deserializeMessage(rows)
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return contextError(ctx, m.queryError(rows.Err()))
+}
+
+// contextError returns ctx's error in place of err, met by a query made with
+// ctx, once ctx is done, as drivers report a cancelled query in their own
+// terms rather than as context.Canceled.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ReadPage reads up to size messages of the stream or category from position
+// from, returning them with the position to read the next page from: past
+// the last message's stream position for an entity stream and past its
+// global position for a category. With no messages next is from.
+func (m *messageDB) ReadPage(streamName string, from, size int) (msgs Messages, next int, err error) {
+	if msgs, err = m.Read(streamName, from, size); err != nil || len(msgs) == 0 {
+		return msgs, from, err
+	}
+	return msgs, nextPosition(streamName, msgs[len(msgs)-1]), nil
+}
+
+// nextPosition returns the position to read from after msg. Entity streams
+// are read by stream position and categories by global position.
+func nextPosition(streamName string, msg *Message) int {
+	if isEntityStream(streamName) {
+		return msg.Position + 1
+	}
+	return msg.GlobalPosition + 1
+}
+
+const defaultBlockSize int = 1000
+
+// budgetContext returns parent bounded by the read budget, if the store has
+// one.
+func (m *messageDB) budgetContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if m.readBudget <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, m.readBudget)
+}
+
+// budgetError returns err, met while reading with ctx from budgetContext, or
+// an ErrReadBudgetExceeded in its place when the budget rather than parent
+// ended the read.
+func budgetError(parent, ctx context.Context, err error, read, position int) error {
+	if parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrReadBudgetExceeded{Read: read, Position: position}
+	}
+	return err
+}
+
+// ReadAll reads every message in the stream or category, a block at a time.
+// Each block is read from just past the last message of the previous one, as
+// global positions within a category are not contiguous.
+func (m *messageDB) ReadAll(streamName string) (Messages, error) {
+	return m.ReadAllContext(context.Background(), streamName)
+}
+
+// ReadAllContext is ReadAll, stopping with ctx's error if ctx is done before
+// every block has been read. The messages read so far are returned with it,
+// as they are with the ErrReadBudgetExceeded of a store with a read budget.
+func (m *messageDB) ReadAllContext(parent context.Context, streamName string) (msgs Messages, err error) {
+	ctx, cancel := m.budgetContext(parent)
+	defer cancel()
+
+	position := 0
+	var more Messages
+	for {
+		if err = ctx.Err(); err != nil {
+			return msgs, budgetError(parent, ctx, err, len(msgs), position)
+		}
+
+		more, err = m.readContext(ctx, streamName, position, m.blockSize)
+		if err != nil {
+			return msgs, budgetError(parent, ctx, err, len(msgs), position)
+		}
+
+		msgs = append(msgs, more...)
+
+		if len(more) != m.blockSize {
+			return msgs, nil
+		}
+
+		position = nextPosition(streamName, more[len(more)-1])
+	}
+}
+
+// Stream returns an iterator over the messages of the stream or category from
+// position from to its current end. Messages are read a block at a time as
+// the iteration reaches them. A read error is yielded with a nil message and
+// ends the iteration.
+func (m *messageDB) Stream(streamName string, from int) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		position := from
+		for {
+			more, err := m.Read(streamName, position, m.blockSize)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, msg := range more {
+				if !yield(msg, nil) {
+					return
+				}
+			}
+
+			if len(more) != m.blockSize {
+				return
+			}
+
+			position = nextPosition(streamName, more[len(more)-1])
+		}
+	}
+}
+
+// ReadByID returns the message of the stream or category with the given ID,
+// or nil if it has none. message-db does not index messages by ID, so the
+// stream is read from the start, a block at a time, until the message is
+// found; it is as expensive as ReadAll for a message near the end of a long
+// stream, and more so for a category.
+func (m *messageDB) ReadByID(streamName, id string) (*Message, error) {
+	for msg, err := range m.Stream(streamName, 0) {
+		if err != nil {
+			return nil, err
+		}
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return nil, nil
+}
+
+// ReadUpTo reads the messages of the stream up to and including position
+// version, the stream as it was when version was written, to rebuild past
+// state. For a category version is a global position. A version past the
+// end of the stream reads all of it.
+func (m *messageDB) ReadUpTo(streamName string, version int) (msgs Messages, err error) {
+	position := 0
+	for position <= version {
+		batchSize := m.blockSize
+		if remaining := version - position + 1; isEntityStream(streamName) && remaining < batchSize {
+			batchSize = remaining
+		}
+
+		var more Messages
+		more, err = m.Read(streamName, position, batchSize)
 		if err != nil {
 			return msgs, err
 		}
-		msgs = append(msgs, msg)
+
+		for _, msg := range more {
+			if nextPosition(streamName, msg) > version+1 {
+				return msgs, nil
+			}
+			msgs = append(msgs, msg)
+		}
+
+		if len(more) != batchSize {
+			return msgs, nil
+		}
+
+		position = nextPosition(streamName, more[len(more)-1])
 	}
 	return msgs, nil
 }
 
-const blockSize int = 1000
+// ReadCategoryForCardinal reads a batch of up to batchSize messages from
+// category starting at global position position, and returns those whose
+// stream has cardinalID as its CardinalID along with the global position to
+// read the next batch from. Messages of other streams are filtered out after
+// reading, so a batch can hold fewer messages than batchSize, or none, before
+// the end of the category is reached; keep reading from the returned position
+// until it stops advancing.
+func (m *messageDB) ReadCategoryForCardinal(category, cardinalID string, position, batchSize int) (msgs Messages, next int, err error) {
+	if isEntityStream(category) {
+		return nil, position, ErrInvalidCategory
+	}
+	if cardinalID == "" {
+		return nil, position, ErrStreamIDRequired
+	}
+
+	next = position
+	err = m.readEach(context.Background(), category, position, batchSize, func(msg *Message) error {
+		next = msg.GlobalPosition + 1
+		if CardinalID(msg.StreamName) == cardinalID {
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	return msgs, next, err
+}
 
-func (m *messageDB) ReadAll(streamName string) (msgs Messages, err error) {
+// ReadSince reads the messages written at or after since.
+//
+// Messages within an entity stream are written in time order, so the first
+// matching position is found by binary search before reading forward. A
+// category interleaves many streams and its global position order is not
+// guaranteed to match time order, so categories are scanned in full and
+// filtered.
+func (m *messageDB) ReadSince(streamName string, since time.Time) (msgs Messages, err error) {
 	position := 0
+	if isEntityStream(streamName) {
+		if position, err = m.firstPositionSince(streamName, since); err != nil || position < 0 {
+			return msgs, err
+		}
+	}
 	var more Messages
 	for {
-		more, err = m.Read(streamName, position, blockSize)
+		more, err = m.Read(streamName, position, m.blockSize)
 		if err != nil {
 			return msgs, err
 		}
 
-		msgs = append(msgs, more...)
+		for _, msg := range more {
+			if !msg.Time.Before(since) {
+				msgs = append(msgs, msg)
+			}
+		}
 
-		if len(more) != blockSize {
+		if len(more) != m.blockSize {
 			return msgs, nil
 		}
 
-		position += blockSize
+		position = nextPosition(streamName, more[len(more)-1])
 	}
 }
 
-const lastStreamMessageSQL string = "SELECT * FROM get_last_stream_message($1)"
+// Replay reads the stream or category forward from position from, calling
+// handler with each message until it reaches the current end. Unlike a
+// subscription it neither polls for new messages nor records its position.
+// It returns the position of the last message handled, a stream position for
+// entity streams and a global position for categories, or from - 1 if none
+// were. If handler returns an error, or the store's read budget runs out,
+// Replay stops with it, and can be resumed from lastPosition + 1.
+func (m *messageDB) Replay(streamName string, from int, handler func(*Message) error) (lastPosition int, err error) {
+	ctx, cancel := m.budgetContext(context.Background())
+	defer cancel()
+
+	lastPosition = from - 1
+	position := from
+	handled := 0
+	var more Messages
+	for {
+		more, err = m.readContext(ctx, streamName, position, m.blockSize)
+		if err != nil {
+			return lastPosition, budgetError(context.Background(), ctx, err, handled, lastPosition+1)
+		}
 
+		for _, msg := range more {
+			if err = ctx.Err(); err != nil {
+				return lastPosition, budgetError(context.Background(), ctx, err, handled, lastPosition+1)
+			}
+			if err = handler(msg); err != nil {
+				return lastPosition, err
+			}
+			lastPosition = nextPosition(streamName, msg) - 1
+			handled++
+		}
+
+		if len(more) != m.blockSize {
+			return lastPosition, nil
+		}
+
+		position = lastPosition + 1
+	}
+}
+
+// firstPositionSince returns the position of the first message in an entity
+// stream written at or after since, or -1 if there is none.
+func (m *messageDB) firstPositionSince(streamName string, since time.Time) (int, error) {
+	last, err := m.ReadLast(streamName)
+	if err != nil || last == nil || last.Time.Before(since) {
+		return -1, err
+	}
+	low, high := 0, last.Position
+	for low < high {
+		mid := low + (high-low)/2
+		msgs, err := m.Read(streamName, mid, 1)
+		if err != nil {
+			return -1, err
+		}
+		if len(msgs) == 0 || !msgs[0].Time.Before(since) {
+			high = mid
+		} else {
+			low = msgs[0].Position + 1
+		}
+	}
+	return low, nil
+}
+
+// LastStreamMessageSQL is the query run by ReadLast.
+const LastStreamMessageSQL string = "SELECT * FROM get_last_stream_message($1)"
+
+// ReadLast returns the last message of the entity stream, or nil if it has
+// none. It fails with ErrEntityStreamRequired for a category, whose last
+// message ReadLastCategory returns.
 func (m *messageDB) ReadLast(streamName string) (*Message, error) {
-	return deserializeMessage(m.db.QueryRow(lastStreamMessageSQL, streamName))
+	if !isEntityStream(streamName) {
+		return nil, ErrEntityStreamRequired
+	}
+	msg, err := deserializeMessage(m.readDB.QueryRow(LastStreamMessageSQL, streamName))
+	return msg, m.diagnoseSchema(err)
+}
+
+// LastCategoryMessageSQL is the query run by ReadLastCategory.
+const LastCategoryMessageSQL string = `SELECT id::varchar, stream_name::varchar, type::varchar, position::bigint, global_position::bigint, data::varchar, metadata::varchar, time::timestamp
+FROM messages WHERE category(stream_name) = $1 ORDER BY global_position DESC LIMIT 1`
+
+// ReadLastCategory returns the message in category with the highest global
+// position, or nil if it has none.
+//
+// message-db has no index on categories, so the query scans the messages
+// table from the newest message back until it finds one in the category,
+// which is slow for a category with no recent messages.
+func (m *messageDB) ReadLastCategory(category string) (*Message, error) {
+	if isEntityStream(category) {
+		return nil, ErrInvalidCategory
+	}
+	msg, err := deserializeMessage(m.readDB.QueryRow(LastCategoryMessageSQL, category))
+	return msg, m.diagnoseSchema(err)
+}
+
+// ErrEntityStreamRequired ...
+var ErrEntityStreamRequired = errors.New("stream name must be an entity stream, not a category")
+
+// ResetSubscriber records a position of 0 for the subscriber so that its next
+// subscription reprocesses the stream from the beginning.
+func (m *messageDB) ResetSubscriber(subscriberID string) error {
+	if subscriberID == "" {
+		return ErrSubscriberIDRequired
+	}
+	_, err := writePosition(m, PositionStreamName(subscriberID), 0, nil)
+	return err
+}
+
+// ResetSubscribers records a position of 0 for each of the subscribers in a
+// single transaction, so that either all of them reprocess their streams from
+// the beginning or, if any write fails, none do. Failed writes are returned
+// as they are by WriteMany.
+func (m *messageDB) ResetSubscribers(subscriberIDs []string) error {
+	msgs := make(Messages, len(subscriberIDs))
+	data := make([][]byte, len(subscriberIDs))
+	metadata := make([][]byte, len(subscriberIDs))
+	for i, subscriberID := range subscriberIDs {
+		if subscriberID == "" {
+			return ErrSubscriberIDRequired
+		}
+		msgs[i] = NewMessage(PositionStreamName(subscriberID), PositionMessageType)
+		msgs[i].Data = map[string]interface{}{
+			globalPositionKey: 0,
+		}
+		var err error
+		if data[i], metadata[i], err = m.prepareWrite(msgs[i]); err != nil {
+			return err
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	tx, err := m.db.BeginTx(context.Background(), m.txOptions)
+	if err != nil {
+		return ErrWrite{msgs[0], err}
+	}
+	for i, msg := range msgs {
+		if _, err = writeMessage(tx, msg, data[i], metadata[i]); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return ErrWrite{msg, err}
+			}
+			return m.diagnoseSchema(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return ErrWrite{msgs[len(msgs)-1], err}
+	}
+	return nil
+}
+
+// Peek returns the next n messages of streamName that the subscriber would
+// read, from just past the global position it last recorded, without
+// recording any position.
+func (m *messageDB) Peek(streamName, subscriberID string, n int) (Messages, error) {
+	if subscriberID == "" {
+		return nil, ErrSubscriberIDRequired
+	}
+	globalPosition, err := NewPositionStore(m).Load(subscriberID)
+	if err != nil {
+		return nil, err
+	}
+	return m.Read(streamName, globalPosition+1, n)
 }
 
 type scanner interface {
@@ -109,77 +965,513 @@ func deserializeMessage(row scanner) (*Message, error) {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
+		return nil, handleQueryError(err)
+	}
+	if err = decodeMessageData(msg, data, metadata); err != nil {
 		return nil, err
 	}
+	return msg, nil
+}
+
+// rowDecoder deserializes the rows of one read. The data of every message is
+// copied into a single shared buffer, rather than one allocation per row, and
+// metadata is decoded straight from the row without being copied at all.
+type rowDecoder struct {
+	buf []byte
+}
+
+func (d *rowDecoder) decode(rows *sql.Rows) (*Message, error) {
+	msg := &Message{}
+	var data, metadata sql.RawBytes
+	if err := rows.Scan(&msg.ID, &msg.StreamName, &msg.Type, &msg.Position, &msg.GlobalPosition, &data, &metadata, &msg.Time); err != nil {
+		return nil, handleQueryError(err)
+	}
+	var rawData []byte
 	if len(data) > 0 {
-		if err = json.Unmarshal(data, &msg.Data); err != nil {
-			return nil, err
+		start := len(d.buf)
+		d.buf = append(d.buf, data...)
+		rawData = d.buf[start:len(d.buf):len(d.buf)]
+	}
+	if err := decodeMessageData(msg, rawData, metadata); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// decodeMessageData sets msg's RawData to data, which it keeps, and decodes
+// data and metadata into its Data and Metadata.
+func decodeMessageData(msg *Message, data, metadata []byte) error {
+	if len(data) > 0 {
+		msg.RawData = data
+		if isJSONObject(data) {
+			if err := json.Unmarshal(data, &msg.Data); err != nil {
+				return err
+			}
 		}
 	}
 	if len(metadata) > 0 {
-		if err = json.Unmarshal(metadata, &msg.Metadata); err != nil {
-			return nil, err
+		if err := json.Unmarshal(metadata, &msg.Metadata); err != nil {
+			return err
 		}
 	}
-	return msg, nil
+	return nil
 }
 
-const writeSQL string = "SELECT write_message($1, $2, $3, $4, $5, $6)"
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
 
-func (m *messageDB) Write(msg *Message) (int, error) {
-	if len(msg.StreamName) == 0 {
-		return 0, ErrStreamNameRequired
+// scanMessageInto scans the current row into msg, reusing its Data map and
+// RawData buffer. The row's data and metadata are scanned without copying and
+// only copied into msg.
+func scanMessageInto(rows *sql.Rows, msg *Message) error {
+	var data, metadata sql.RawBytes
+	if err := rows.Scan(&msg.ID, &msg.StreamName, &msg.Type, &msg.Position, &msg.GlobalPosition, &data, &metadata, &msg.Time); err != nil {
+		return handleQueryError(err)
+	}
+	msg.RawData = append(msg.RawData[:0], data...)
+	for key := range msg.Data {
+		delete(msg.Data, key)
+	}
+	if isJSONObject(data) {
+		if err := json.Unmarshal(data, &msg.Data); err != nil {
+			return err
+		}
+	}
+	msg.Metadata = nil
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &msg.Metadata); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if len(msg.Type) == 0 {
-		return 0, ErrTypeRequired
+// WriteMessageSQL is the query run by Write.
+const WriteMessageSQL string = "SELECT write_message($1, $2, $3, $4, $5, $6)"
+
+// Write writes msg and returns the position it was written at, the
+// next_position write_message reports. For an entity stream that is the
+// stream's new version, so an aggregate can keep it and pass it as the
+// ExpectedVersion of its next message to chain writes without reading the
+// stream again.
+func (m *messageDB) Write(msg *Message) (int, error) {
+	return m.intercept(m.write)(context.Background(), msg)
+}
+
+// WriteContext writes msg like Write, in a transaction bound to ctx, first
+// filling in any of its metadata that is unset from the values the store's
+// WithMetadataFromContext extractor finds in ctx.
+func (m *messageDB) WriteContext(ctx context.Context, msg *Message) (int, error) {
+	if m.metadataFromContext != nil {
+		if err := msg.mergeMetadata(m.metadataFromContext(ctx)); err != nil {
+			return 0, err
+		}
 	}
+	return m.intercept(m.write)(ctx, msg)
+}
 
-	if msg.ID == "" {
-		msg.ID = uuid.New().String()
+// intercept wraps write in the store's write interceptors.
+func (m *messageDB) intercept(write WriteFunc) WriteFunc {
+	for i := len(m.writeInterceptors) - 1; i >= 0; i-- {
+		write = m.writeInterceptors[i](write)
 	}
+	return write
+}
 
-	data, err := json.Marshal(msg.Data)
+func (m *messageDB) write(ctx context.Context, msg *Message) (int, error) {
+	data, metadata, err := m.prepareWrite(msg)
 	if err != nil {
 		return 0, err
 	}
 
-	metadata, err := json.Marshal(msg.Metadata)
+	tx, err := m.db.BeginTx(ctx, m.txOptions)
 	if err != nil {
-		return 0, err
+		return 0, ErrWrite{msg, err}
 	}
 
-	tx, err := m.db.Begin()
+	nextPosition, err := writeMessage(tx, msg, data, metadata)
 	if err != nil {
-		return 0, err
+		if err := tx.Rollback(); err != nil {
+			return 0, ErrWrite{msg, err}
+		}
+		return 0, m.diagnoseSchema(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, ErrWrite{msg, err}
 	}
+	return nextPosition, nil
+}
 
-	res := tx.QueryRow(writeSQL, msg.ID, msg.StreamName, msg.Type, data, metadata, msg.ExpectedVersion)
+// WriteTx writes msg within tx, a transaction the caller began and will
+// commit or roll back, so the message is written atomically with the caller's
+// other changes. tx may come from an ORM sharing the same database:
+//
+//	tx := gormDB.Begin()
+//	sqlTx := tx.Statement.ConnPool.(*sql.Tx)
+//
+// or, with sqlx, the *sql.Tx embedded in an *sqlx.Tx:
+//
+//	sqlTx := sqlxTx.Tx
+//
+// If the write fails, message-db has aborted tx and it must be rolled back.
+func (m *messageDB) WriteTx(tx *sql.Tx, msg *Message) (int, error) {
+	return m.intercept(func(_ context.Context, msg *Message) (int, error) {
+		data, metadata, err := m.prepareWrite(msg)
+		if err != nil {
+			return 0, err
+		}
+		nextPosition, err := writeMessage(tx, msg, data, metadata)
+		return nextPosition, m.diagnoseSchema(err)
+	})(context.Background(), msg)
+}
 
-	var nextPosition int
-	if err = res.Scan(&nextPosition); err != nil {
-		if err := tx.Rollback(); err != nil {
+// WriteMany writes msgs to streamName in a single transaction, so they land
+// contiguously, returning the position of the last one, which like Write's is
+// the new version of an entity stream. When expectedVersion
+// is set each message expects the stream to be at the version the message
+// before it left, starting from expectedVersion. If any write fails, none of
+// the messages are written. With no messages nothing is written. Errors that
+// are not about a particular message, such as failing to begin or commit the
+// transaction, are returned as an ErrWrite for the first or the last message.
+func (m *messageDB) WriteMany(streamName string, expectedVersion *int, msgs Messages) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	data := make([][]byte, len(msgs))
+	metadata := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		msg.StreamName = streamName
+		msg.ExpectedVersion = nil
+		if expectedVersion != nil {
+			version := *expectedVersion + i
+			msg.ExpectedVersion = &version
+		}
+		var err error
+		if data[i], metadata[i], err = m.prepareWrite(msg); err != nil {
 			return 0, err
 		}
-		return 0, handleWriteError(err, msg)
+	}
+
+	tx, err := m.db.BeginTx(context.Background(), m.txOptions)
+	if err != nil {
+		return 0, ErrWrite{msgs[0], err}
+	}
+
+	var nextPosition int
+	for i, msg := range msgs {
+		if nextPosition, err = writeMessage(tx, msg, data[i], metadata[i]); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, ErrWrite{msg, err}
+			}
+			return 0, m.diagnoseSchema(err)
+		}
 	}
 	if err = tx.Commit(); err != nil {
-		return 0, err
+		return 0, ErrWrite{msgs[len(msgs)-1], err}
+	}
+	return nextPosition, nil
+}
+
+// prepareWrite validates msg, assigns it an ID if it has none, and returns
+// its data and metadata as JSON.
+func (m *messageDB) prepareWrite(msg *Message) (data, metadata []byte, err error) {
+	m.stampSchemaVersion(msg)
+
+	if data, metadata, err = encodeMessage(msg, m.maxPayloadBytes); err != nil {
+		return nil, nil, err
+	}
+
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+
+	if m.canonicalJSON {
+		if data, err = canonicalizeJSON(data); err != nil {
+			return nil, nil, err
+		}
+		if metadata, err = canonicalizeJSON(metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, metadata, nil
+}
+
+// stampSchemaVersion sets the schema version registered for msg's type on msg
+// if it has none.
+func (m *messageDB) stampSchemaVersion(msg *Message) {
+	version, ok := m.schemaVersions[msg.Type]
+	if !ok || msg.SchemaVersion() != 0 {
+		return
+	}
+	if msg.Metadata == nil {
+		msg.Metadata = &Metadata{}
+	}
+	msg.Metadata.SchemaVersion = version
+}
+
+// ValidateWrite runs the checks Write makes on msg itself before writing it
+// and returns the error Write would fail with, without writing it or touching
+// msg. A nil error does not mean the write will succeed, the expected version
+// can still conflict with the stream. It knows nothing of the store msg will
+// be written to, so payload sizes are checked against DefaultMaxPayloadBytes
+// rather than a WithMaxPayloadBytes limit, and msg is checked as it is, before
+// the store's WithSchemaVersion stamping or WithWriteInterceptor interceptors
+// could change or reject it.
+func ValidateWrite(msg *Message) error {
+	_, _, err := encodeMessage(msg, DefaultMaxPayloadBytes)
+	return err
+}
+
+// encodeMessage validates msg and returns its data and metadata as JSON,
+// neither of which may be larger than maxPayloadBytes.
+func encodeMessage(msg *Message, maxPayloadBytes int) (data, metadata []byte, err error) {
+	if len(msg.StreamName) == 0 {
+		return nil, nil, ErrStreamNameRequired
+	}
+
+	if len(msg.Type) == 0 {
+		return nil, nil, ErrTypeRequired
+	}
+
+	if msg.ExpectedVersion != nil && *msg.ExpectedVersion < noStreamVersion {
+		return nil, nil, ErrInvalidExpectedVersion
+	}
+
+	if data, err = messageData(msg); err != nil {
+		return nil, nil, err
+	}
+
+	if metadata, err = json.Marshal(msg.Metadata); err != nil {
+		return nil, nil, err
+	}
+
+	for _, payload := range [][]byte{data, metadata} {
+		if len(payload) > maxPayloadBytes {
+			return nil, nil, ErrPayloadTooLarge{len(payload)}
+		}
+	}
+	return data, metadata, nil
+}
+
+// querier is the part of *sql.DB and *sql.Tx that writes use.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func writeMessage(q querier, msg *Message, data, metadata []byte) (int, error) {
+	res := q.QueryRow(WriteMessageSQL, msg.ID, msg.StreamName, msg.Type, data, metadata, msg.ExpectedVersion)
+
+	var nextPosition int
+	if err := res.Scan(&nextPosition); err != nil {
+		return 0, handleWriteError(err, msg)
 	}
 	return nextPosition, nil
 }
 
-var versionConflictRegex = regexp.MustCompile(".*Wrong.*Stream Version: (?P<ActualVersion>\\d+)\\)$")
+// messageData returns the data to write for msg, its RawData if set and
+// otherwise its Data marshaled to JSON.
+func messageData(msg *Message) ([]byte, error) {
+	if len(msg.RawData) == 0 {
+		return json.Marshal(msg.Data)
+	}
+	if !json.Valid(msg.RawData) {
+		return nil, ErrInvalidRawData
+	}
+	return msg.RawData, nil
+}
+
+// WriteSequence writes msgs to streamName in order, each expecting the stream
+// to be at version startVersion + i, where i is its index, so that a retried
+// sequence conflicts at the first message that was already written rather
+// than writing it twice. Use -1 as startVersion for a stream that should not
+// exist yet.
+//
+// Each message is written in its own transaction. WriteSequence returns the
+// number of messages written, which on error is the index of the message that
+// failed, so the caller can resume from there.
+func (m *messageDB) WriteSequence(streamName string, startVersion int, msgs Messages) (int, error) {
+	for i, msg := range msgs {
+		expectedVersion := startVersion + i
+		msg.StreamName = streamName
+		msg.ExpectedVersion = &expectedVersion
+		if _, err := m.Write(msg); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// writeIfAttempts is how many times WriteIf reads and decides before giving
+// up on a stream that keeps changing under it.
+const writeIfAttempts int = 10
+
+// WriteIf writes msg to streamName only if the stream's current state allows
+// it. It reads every message in the stream and passes them to fold, which
+// returns whether msg may be written and the version the stream must still be
+// at, usually the position of the last message it folded, or -1 for an empty
+// stream. msg is written expecting that version, so a write made by another
+// writer since the read fails with a version conflict rather than skipping
+// the check; WriteIf then reads the stream and calls fold again, up to 10
+// times before returning the conflict. It returns ErrConditionNotMet, without
+// writing, when fold does not allow the write.
+func (m *messageDB) WriteIf(streamName string, fold func(Messages) (ok bool, expectedVersion int), msg *Message) (nextPosition int, err error) {
+	if streamName == "" {
+		return 0, ErrStreamNameRequired
+	}
+	msg.StreamName = streamName
+
+	for attempt := 0; attempt < writeIfAttempts; attempt++ {
+		var msgs Messages
+		if msgs, err = m.primary().ReadAll(streamName); err != nil {
+			return 0, err
+		}
+		ok, expectedVersion := fold(msgs)
+		if !ok {
+			return 0, ErrConditionNotMet
+		}
+		msg.ExpectedVersion = &expectedVersion
+		if nextPosition, err = m.Write(msg); !isVersionConflict(err) {
+			return nextPosition, err
+		}
+	}
+	return 0, err
+}
+
+// ErrConditionNotMet ...
+var ErrConditionNotMet = errors.New("stream does not meet the condition for the write")
+
+// WriteWithRetry writes msg, retrying failed writes according to policy. The
+// message ID is assigned before the first attempt so every retry writes the
+// same message. A retry that finds msg's ID already written to its stream
+// takes it for an earlier attempt that succeeded without hearing so, such as
+// when the connection dropped before the commit was acknowledged, and returns
+// the position that attempt wrote msg at.
+func (m *messageDB) WriteWithRetry(msg *Message, policy RetryPolicy) (int, error) {
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+
+	var nextPosition int
+	attempt := 0
+	err := policy.Do(func() (err error) {
+		attempt++
+		nextPosition, err = m.Write(msg)
+		var duplicate ErrDuplicateMessageID
+		if attempt == 1 || !errors.As(err, &duplicate) || duplicate.ID != msg.ID {
+			return err
+		}
+		position, written, findErr := m.writtenPosition(msg)
+		if findErr != nil {
+			return findErr
+		}
+		if !written {
+			return err
+		}
+		nextPosition = position
+		return nil
+	})
+	return nextPosition, err
+}
+
+// WrittenPositionSQL is the query WriteWithRetry runs to find the position an
+// earlier attempt wrote a message at.
+const WrittenPositionSQL string = "SELECT position FROM messages WHERE id = $1 AND stream_name = $2"
+
+// writtenPosition returns the position msg was written to its stream at, and
+// whether it was, reading from the primary.
+func (m *messageDB) writtenPosition(msg *Message) (int, bool, error) {
+	var position int
+	err := m.db.QueryRow(WrittenPositionSQL, msg.ID, msg.StreamName).Scan(&position)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, m.queryError(err)
+	}
+	return position, true, nil
+}
+
+var versionConflictRegex = regexp.MustCompile(".*Wrong.*Stream Version: (?P<ActualVersion>-?\\d+)\\)$")
+
+// noStreamVersion is the stream version message-db reports for a stream
+// that has no messages.
+const noStreamVersion int = -1
+
+// uniqueViolation is the SQLSTATE Postgres reports when a write would
+// duplicate a unique key, such as a message ID that has already been written.
+const uniqueViolation string = "23505"
+
+// undefinedFunction is the SQLSTATE Postgres reports when a query calls a
+// function that does not exist, as the message-db functions do not when its
+// schema is not installed or not on the search_path.
+const undefinedFunction string = "42883"
+
+// sqlStateError is implemented by the errors of Postgres drivers such as pgx
+// and lib/pq.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// handleQueryError wraps errors from queries of message-db functions that
+// do not exist in an ErrSchemaNotInstalled.
+func handleQueryError(err error) error {
+	if hasSQLState(err, undefinedFunction) {
+		return ErrSchemaNotInstalled{err}
+	}
+	return err
+}
+
+// queryError is handleQueryError, going on to diagnose a search_path that
+// leaves out message-db's schema.
+func (m *messageDB) queryError(err error) error {
+	return m.diagnoseSchema(handleQueryError(err))
+}
+
+// InstalledSchemaSQL is the query run to find the schema message-db is
+// installed in when its functions cannot be found.
+const InstalledSchemaSQL string = "SELECT n.nspname FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace WHERE p.proname = 'write_message' LIMIT 1"
+
+// diagnoseSchema returns err, or an ErrSearchPathNotSet in place of an
+// ErrSchemaNotInstalled when message-db is installed in a schema that is not
+// on the search_path.
+func (m *messageDB) diagnoseSchema(err error) error {
+	var notInstalled ErrSchemaNotInstalled
+	if !errors.As(err, &notInstalled) {
+		return err
+	}
+	var schema string
+	if m.db.QueryRow(InstalledSchemaSQL).Scan(&schema) != nil {
+		return err
+	}
+	return ErrSearchPathNotSet{schema, notInstalled.Err}
+}
+
+func hasSQLState(err error, state string) bool {
+	var stateErr sqlStateError
+	return errors.As(err, &stateErr) && stateErr.SQLState() == state
+}
 
 func handleWriteError(err error, msg *Message) error {
+	if hasSQLState(err, uniqueViolation) {
+		return ErrDuplicateMessageID{msg.ID}
+	}
+	if hasSQLState(err, undefinedFunction) {
+		return ErrSchemaNotInstalled{err}
+	}
 	errorMatches := versionConflictRegex.FindStringSubmatch(err.Error())
 	if len(errorMatches) == 0 {
-		return err
+		return ErrWrite{msg, err}
 	}
 	actualVersion, err := strconv.Atoi(errorMatches[1])
 	if err != nil {
 		actualVersion = -1
 	}
+	if actualVersion == noStreamVersion {
+		return ErrStreamDoesNotExist{msg.StreamName, msg.ExpectedVersion}
+	}
 	return ErrVersionConflict{msg.StreamName, actualVersion, msg.ExpectedVersion}
 }
 
@@ -189,6 +1481,96 @@ var ErrStreamNameRequired = errors.New("missing stream name")
 // ErrTypeRequired ...
 var ErrTypeRequired = errors.New("missing type")
 
+// ErrInvalidExpectedVersion ...
+var ErrInvalidExpectedVersion = errors.New("expected version must be -1 or greater")
+
+// ErrInvalidRawData ...
+var ErrInvalidRawData = errors.New("raw data is not valid JSON")
+
+// ErrPayloadTooLarge is returned when a message's data or metadata, Bytes
+// long as JSON, is larger than the store's maximum payload size.
+type ErrPayloadTooLarge struct {
+	Bytes int
+}
+
+func (err ErrPayloadTooLarge) Error() string {
+	return fmt.Sprintf("message payload of %d bytes is too large", err.Bytes)
+}
+
+// ErrWrite is returned when writing Message fails for a reason other than a
+// version conflict, a duplicate ID or a missing schema, such as a lost
+// connection.
+type ErrWrite struct {
+	Message *Message
+	Err     error
+}
+
+func (err ErrWrite) Error() string {
+	return fmt.Sprintf("writing message %s of type %s to stream %s: %s", err.Message.ID, err.Message.Type, err.Message.StreamName, err.Err)
+}
+
+// Unwrap ...
+func (err ErrWrite) Unwrap() error {
+	return err.Err
+}
+
+// ErrSchemaNotInstalled ...
+type ErrSchemaNotInstalled struct {
+	Err error
+}
+
+func (err ErrSchemaNotInstalled) Error() string {
+	return fmt.Sprintf("message-db schema is not installed or not on the search_path, run the message-db database scripts: %s", err.Err)
+}
+
+// Unwrap ...
+func (err ErrSchemaNotInstalled) Unwrap() error {
+	return err.Err
+}
+
+// ErrSearchPathNotSet is returned in place of an ErrSchemaNotInstalled when
+// message-db is installed, in Schema, but the connection's search_path does
+// not include it, so its functions are not found.
+type ErrSearchPathNotSet struct {
+	Schema string
+	Err    error
+}
+
+func (err ErrSearchPathNotSet) Error() string {
+	return fmt.Sprintf("message-db is installed in the '%s' schema but it is not on the search_path, open the database with Connect(driverName, dsn, \"%s\") or set the search_path of every connection: %s", err.Schema, err.Schema, err.Err)
+}
+
+// Unwrap ...
+func (err ErrSearchPathNotSet) Unwrap() error {
+	return err.Err
+}
+
+// ErrReadBudgetExceeded is returned by a read that ran out of the budget set
+// by WithReadBudget. Read is how many messages were read, or handled by
+// Replay, and the read can be resumed from Position.
+type ErrReadBudgetExceeded struct {
+	Read     int
+	Position int
+}
+
+func (err ErrReadBudgetExceeded) Error() string {
+	return fmt.Sprintf("read budget exceeded after %d messages, resume from position %d", err.Read, err.Position)
+}
+
+// Unwrap ...
+func (err ErrReadBudgetExceeded) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// ErrDuplicateMessageID ...
+type ErrDuplicateMessageID struct {
+	ID string
+}
+
+func (err ErrDuplicateMessageID) Error() string {
+	return fmt.Sprintf("message '%s' has already been written", err.ID)
+}
+
 // ErrVersionConflict ...
 type ErrVersionConflict struct {
 	StreamName      string
@@ -205,3 +1587,19 @@ func (err ErrVersionConflict) Error() string {
 	}
 	return fmt.Sprintf("version conflict on '%s' stream: got %d, want %s", err.StreamName, err.ActualVersion, expectedVersion)
 }
+
+// ErrStreamDoesNotExist ...
+type ErrStreamDoesNotExist struct {
+	StreamName      string
+	ExpectedVersion *int
+}
+
+func (err ErrStreamDoesNotExist) Error() string {
+	var expectedVersion string
+	if err.ExpectedVersion != nil {
+		expectedVersion = fmt.Sprintf("%d", *err.ExpectedVersion)
+	} else {
+		expectedVersion = fmt.Sprintf("%v", nil)
+	}
+	return fmt.Sprintf("stream '%s' does not exist: want version %s", err.StreamName, expectedVersion)
+}
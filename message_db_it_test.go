@@ -4,7 +4,6 @@
 package messagedb
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
@@ -22,39 +21,16 @@ import (
 const (
 	defaultStoreUrl = "postgresql://message_store:@localhost:5432/message_store"
 	defaultStoreDb  = "message_store"
-	publicSchema    = "public"
-
-	// EnvMessageStoreDb is the name of the environment variable that specifies the database used for message-db
-	EnvMessageStoreDb = "MESSAGE_STORE_DB"
 
 	// EnvDbUrl is the name of the environment variable that specifies the databae connection url used for message-db
 	EnvDbUrl = "MESSAGE_STORE_DB_URL"
 )
 
-// Setup will be executed by NewDb against the database after establishing a connection.
-type Setup func(*sql.DB) error
-
-// NewDb establishes a connection to the database and executes any setup provided
-func NewDb(driver string, conn string, setup Setup) (db *sql.DB, err error) {
-	if db, err = sql.Open(driver, conn); err != nil {
-		return nil, err
-	}
-
-	if setup != nil {
-		return db, setup(db)
-	}
-
-	return db, nil
-}
-
 // Writes multiple messages to two different streams, and insures every message is read.
 //
 // This test uses unique stream names and subscriber ids for each test.
 func Test_WriteMessage(t *testing.T) {
-	s, err := NewDb("pgx", GetOrDefault(EnvDbUrl, defaultStoreUrl), func(db *sql.DB) error {
-		_, err := db.Exec(fmt.Sprintf("SET search_path TO %s, %s", GetOrDefault(EnvMessageStoreDb, defaultStoreDb), publicSchema))
-		return err
-	})
+	s, err := Connect("pgx", GetOrDefault(EnvDbUrl, defaultStoreUrl), GetOrDefault(EnvMessageStoreDb, defaultStoreDb))
 	require.Nil(t, err, "error creating an sql.DB: %v", err)
 
 	messageStore := New(s)
@@ -112,7 +88,7 @@ func Test_WriteMessage(t *testing.T) {
 
 			var subscribers Subscribers
 			subscribers = map[string]Subscriber{
-				test.t: func(m *Message) {
+				test.t: func(m *Message) error {
 
 					// only update the read struct if we have never seen the message before
 					if _, read := readState[m.ID]; !read {
@@ -129,6 +105,7 @@ func Test_WriteMessage(t *testing.T) {
 					} else {
 						assert.Fail(t, fmt.Sprintf("Duplicate message received: stream '%s', message id '%s', stream position '%d', global position '%d'", m.StreamName, m.ID, m.Position, m.GlobalPosition))
 					}
+					return nil
 				},
 			}
 
@@ -1,6 +1,8 @@
 package messagedb_test
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"testing"
@@ -9,8 +11,11 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/brycedarling/messagedb"
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 )
 
+var errConnectionReset = errors.New("connection reset by peer")
+
 func TestCreateSubscription(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -29,12 +34,14 @@ func TestCreateSubscription(t *testing.T) {
 	mock.ExpectQuery("get_last_stream_message").
 		WithArgs(subscriberStreamName).
 		WillReturnRows(mock.NewRows(columns).
-			AddRow(uuid.New(), subscriberStreamName, "Read", 0, 0, nil, nil, time.Now()))
+			AddRow(uuid.New(), subscriberStreamName, "Read", 0, 0, []byte(`{"globalPosition":0}`), nil, time.Now()))
 
 	mock.ExpectQuery("get_category_messages").
 		WithArgs(streamName, 1, 100).
 		WillReturnRows(mock.NewRows(columns).
-			AddRow(uuid.New(), streamName, messageType, 0, 0, nil, nil, time.Now()))
+			AddRow(uuid.New(), streamName, messageType, 0, 1, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
 
 	m := messagedb.New(db)
 
@@ -46,15 +53,17 @@ func TestCreateSubscription(t *testing.T) {
 	subscriberCalled, otherCalled := false, false
 
 	errs := sub.Subscribe(messagedb.Subscribers{
-		messageType: func(m *messagedb.Message) {
+		messageType: func(m *messagedb.Message) error {
 			subscriberCalled = true
 
 			sub.Unsubscribe()
+			return nil
 		},
-		"other": func(m *messagedb.Message) {
+		"other": func(m *messagedb.Message) error {
 			otherCalled = true
 
 			sub.Unsubscribe()
+			return nil
 		},
 	})
 
@@ -146,7 +155,7 @@ func TestReadAll(t *testing.T) {
 		WithArgs(streamName, 0, 1000).
 		WillReturnRows(firstPage)
 	mock.ExpectQuery("get_category_messages").
-		WithArgs(streamName, 1000, 1000).
+		WithArgs(streamName, 1001, 1000).
 		WillReturnRows(secondPage)
 
 	reader := messagedb.New(db)
@@ -159,6 +168,71 @@ func TestReadAll(t *testing.T) {
 	if len(msgs) != 1337 {
 		t.Errorf("expected 1337 messages, got %d", len(msgs))
 	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadAllNonContiguous(t *testing.T) {
+	var tests = []struct {
+		name       string
+		streamName string
+		query      string
+		position   func(i int) int
+		// next is the position the second page is read from
+		next int
+	}{
+		// Categories interleave entity streams so global positions have gaps
+		{"category", "category", "get_category_messages", func(i int) int { return i * 3 }, 2999},
+		{"stream", "stream-1", "get_stream_messages", func(i int) int { return i }, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			firstPage := mock.NewRows(columns)
+			for i := 0; i < 1000; i++ {
+				firstPage.AddRow(uuid.New(), tt.streamName, "type", i, tt.position(i)+1, nil, nil, time.Now())
+			}
+			secondPage := mock.NewRows(columns)
+			for i := 1000; i < 1010; i++ {
+				secondPage.AddRow(uuid.New(), tt.streamName, "type", i, tt.position(i)+1, nil, nil, time.Now())
+			}
+
+			mock.ExpectQuery(tt.query).
+				WithArgs(tt.streamName, 0, 1000).
+				WillReturnRows(firstPage)
+			mock.ExpectQuery(tt.query).
+				WithArgs(tt.streamName, tt.next, 1000).
+				WillReturnRows(secondPage)
+
+			msgs, err := messagedb.New(db).ReadAll(tt.streamName)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when reading all", err)
+			}
+
+			if len(msgs) != 1010 {
+				t.Errorf("expected 1010 messages, got %d", len(msgs))
+			}
+			for i := 1; i < len(msgs); i++ {
+				if msgs[i].GlobalPosition <= msgs[i-1].GlobalPosition {
+					t.Fatalf("messages out of order at %d", i)
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
 }
 
 func TestReadLast(t *testing.T) {
@@ -168,13 +242,13 @@ func TestReadLast(t *testing.T) {
 	}
 	defer db.Close()
 
-	streamName := "readlast"
+	streamName := "readlast-1"
 
 	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
 
 	mock.ExpectQuery("get_last_stream_message").
 		WithArgs(streamName).
-		WillReturnRows(mock.NewRows(columns).AddRow(uuid.New(), streamName, "type", 0, 0, nil, nil, time.Now()))
+		WillReturnRows(mock.NewRows(columns).AddRow(uuid.New(), streamName, "type", 0, 0, nil, []byte(`{"correlationStreamName":"correlation"}`), time.Now()))
 
 	m := messagedb.New(db)
 
@@ -186,9 +260,14 @@ func TestReadLast(t *testing.T) {
 	if msg.StreamName != streamName {
 		t.Errorf("got %s, expected stream name %s", msg.StreamName, streamName)
 	}
+	if msg.CorrelationStreamName() != "correlation" {
+		t.Errorf("got %s, expected correlation stream name %s", msg.CorrelationStreamName(), "correlation")
+	}
 }
 
 func TestWrite(t *testing.T) {
+	expectedVersion := 0
+
 	var tests = []struct {
 		name            string
 		streamName      string
@@ -217,6 +296,40 @@ func TestWrite(t *testing.T) {
 				t.Errorf("got %s, want error version conflict", err)
 			}
 		}},
+		{"stream does not exist", "test", "type", &expectedVersion, func(mock sqlmock.Sqlmock, msg *messagedb.Message) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WillReturnError(errors.New("Wrong expected version: 0 (Stream: test, Stream Version: -1)"))
+			mock.ExpectRollback()
+		}, func(err error) {
+			if _, ok := err.(messagedb.ErrStreamDoesNotExist); !ok {
+				t.Errorf("got %s, want error stream does not exist", err)
+			}
+		}},
+		{"duplicate message id", "test", "type", nil, func(mock sqlmock.Sqlmock, msg *messagedb.Message) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WillReturnError(&pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint \"messages_id\""})
+			mock.ExpectRollback()
+		}, func(err error) {
+			if _, ok := err.(messagedb.ErrDuplicateMessageID); !ok {
+				t.Errorf("got %s, want error duplicate message id", err)
+			}
+		}},
+		{"connection failure", "test", "type", nil, func(mock sqlmock.Sqlmock, msg *messagedb.Message) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WillReturnError(errConnectionReset)
+			mock.ExpectRollback()
+		}, func(err error) {
+			var writeErr messagedb.ErrWrite
+			if !errors.As(err, &writeErr) || writeErr.Message.StreamName != "test" {
+				t.Errorf("got %s, want error write for stream test", err)
+			}
+			if !errors.Is(err, errConnectionReset) {
+				t.Errorf("got %s, want it to wrap %s", err, errConnectionReset)
+			}
+		}},
 		{"valid", "stream", "type", nil,
 			func(mock sqlmock.Sqlmock, msg *messagedb.Message) {
 				null := []uint8("null")
@@ -261,3 +374,1823 @@ func TestWrite(t *testing.T) {
 		})
 	}
 }
+
+func TestResetSubscriber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), subscriberStreamName, "Read", []uint8(`{"globalPosition":0}`), []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db)
+
+	if err := m.ResetSubscriber(subscriberID); err != nil {
+		t.Fatalf("unexpected error '%s' when resetting subscriber", err)
+	}
+
+	if err := m.ResetSubscriber(""); err != messagedb.ErrSubscriberIDRequired {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrSubscriberIDRequired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestResetSubscribers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	m := messagedb.New(db)
+
+	t.Run("all in one transaction", func(t *testing.T) {
+		mock.ExpectBegin()
+		for _, subscriberID := range []string{"a", "b"} {
+			mock.ExpectQuery("write_message").
+				WithArgs(sqlmock.AnyArg(), "subscriberPosition-"+subscriberID, "Read", []uint8(`{"globalPosition":0}`), []uint8("null"), nil).
+				WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+		}
+		mock.ExpectCommit()
+
+		if err := m.ResetSubscribers([]string{"a", "b"}); err != nil {
+			t.Fatalf("unexpected error '%s' when resetting subscribers", err)
+		}
+	})
+
+	t.Run("rolls back on failure", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("write_message").
+			WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+		mock.ExpectQuery("write_message").
+			WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		if err := m.ResetSubscribers([]string{"a", "b"}); !errors.Is(err, sql.ErrConnDone) {
+			t.Errorf("got %v, want error %s", err, sql.ErrConnDone)
+		}
+	})
+
+	t.Run("subscriber ID required", func(t *testing.T) {
+		if err := m.ResetSubscribers([]string{"a", ""}); err != messagedb.ErrSubscriberIDRequired {
+			t.Errorf("got %v, want error %s", err, messagedb.ErrSubscriberIDRequired)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadSince(t *testing.T) {
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	start := time.Now().Add(-time.Hour)
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * time.Minute)
+	}
+	since := at(2)
+
+	t.Run("stream", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		streamName := "stream-1"
+		row := func(rows *sqlmock.Rows, i int) *sqlmock.Rows {
+			return rows.AddRow(uuid.New(), streamName, "type", i, i+10, nil, nil, at(i))
+		}
+
+		mock.ExpectQuery("get_last_stream_message").
+			WithArgs(streamName).
+			WillReturnRows(row(mock.NewRows(columns), 4))
+		mock.ExpectQuery("get_stream_messages").
+			WithArgs(streamName, 2, 1).
+			WillReturnRows(row(mock.NewRows(columns), 2))
+		mock.ExpectQuery("get_stream_messages").
+			WithArgs(streamName, 1, 1).
+			WillReturnRows(row(mock.NewRows(columns), 1))
+		mock.ExpectQuery("get_stream_messages").
+			WithArgs(streamName, 2, 1000).
+			WillReturnRows(row(row(row(mock.NewRows(columns), 2), 3), 4))
+
+		msgs, err := messagedb.New(db).ReadSince(streamName, since)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when reading since", err)
+		}
+
+		if len(msgs) != 3 || msgs[0].Position != 2 {
+			t.Errorf("expected 3 messages from position 2, got %d", len(msgs))
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %s", err)
+		}
+	})
+
+	t.Run("category", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		category := "category"
+
+		rows := mock.NewRows(columns)
+		for i := 0; i < 5; i++ {
+			rows.AddRow(uuid.New(), fmt.Sprintf("%s-%d", category, i%2), "type", i/2, i, nil, nil, at(i))
+		}
+		mock.ExpectQuery("get_category_messages").
+			WithArgs(category, 0, 1000).
+			WillReturnRows(rows)
+
+		msgs, err := messagedb.New(db).ReadSince(category, since)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when reading since", err)
+		}
+
+		if len(msgs) != 3 || msgs[0].GlobalPosition != 2 {
+			t.Errorf("expected 3 messages from global position 2, got %d", len(msgs))
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %s", err)
+		}
+	})
+}
+
+func TestWriteWithRetry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	msg := &messagedb.Message{StreamName: "stream-1", Type: "type"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), msg.StreamName, msg.Type, sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("7"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db)
+
+	position, err := m.WriteWithRetry(msg, messagedb.RetryPolicy{MaxAttempts: 2})
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when writing with retry", err)
+	}
+	if position != 7 {
+		t.Errorf("got position %d, want %d", position, 7)
+	}
+	if msg.ID == "" {
+		t.Errorf("expected message id")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteWithRetryFindsEarlierAttempt(t *testing.T) {
+	var tests = []struct {
+		name     string
+		rows     *sqlmock.Rows
+		position int
+		wantErr  bool
+	}{
+		{"written by the earlier attempt", sqlmock.NewRows([]string{"position"}).AddRow(4), 4, false},
+		{"written by another message", sqlmock.NewRows([]string{"position"}), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			msg := &messagedb.Message{StreamName: "stream-1", Type: "type"}
+
+			// The first attempt is written but its commit is never
+			// acknowledged, so the retry finds its ID taken.
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("4"))
+			mock.ExpectCommit().WillReturnError(errConnectionReset)
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WillReturnError(&pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint \"messages_id\""})
+			mock.ExpectRollback()
+			mock.ExpectQuery("SELECT position FROM messages").
+				WithArgs(sqlmock.AnyArg(), msg.StreamName).
+				WillReturnRows(tt.rows)
+
+			m := messagedb.New(db)
+
+			position, err := m.WriteWithRetry(msg, messagedb.RetryPolicy{MaxAttempts: 2})
+			var duplicate messagedb.ErrDuplicateMessageID
+			if tt.wantErr != errors.As(err, &duplicate) {
+				t.Errorf("got error %v, want ErrDuplicateMessageID %t", err, tt.wantErr)
+			}
+			if position != tt.position {
+				t.Errorf("got position %d, want %d", position, tt.position)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestCategories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT DISTINCT category").
+		WithArgs("", 2).
+		WillReturnRows(mock.NewRows([]string{"category"}).AddRow("account").AddRow("order"))
+	mock.ExpectQuery("SELECT DISTINCT category").
+		WithArgs("order", nil).
+		WillReturnRows(mock.NewRows([]string{"category"}).AddRow("subscriberPosition"))
+
+	m := messagedb.New(db)
+
+	categories, err := m.Categories("", 2)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading categories", err)
+	}
+	if fmt.Sprint(categories) != "[account order]" {
+		t.Errorf("got categories %v, want [account order]", categories)
+	}
+
+	categories, err = m.Categories(categories[len(categories)-1], 0)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading categories", err)
+	}
+	if fmt.Sprint(categories) != "[subscriberPosition]" {
+		t.Errorf("got categories %v, want [subscriberPosition]", categories)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestMaxGlobalPosition(t *testing.T) {
+	var tests = []struct {
+		name     string
+		position interface{}
+		want     int
+	}{
+		{"messages", 42, 42},
+		{"empty store", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("max\\(global_position\\)").
+				WillReturnRows(mock.NewRows([]string{"max"}).AddRow(tt.position))
+
+			position, err := messagedb.New(db).MaxGlobalPosition()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when reading max global position", err)
+			}
+			if position != tt.want {
+				t.Errorf("got global position %d, want %d", position, tt.want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestMessageCount(t *testing.T) {
+	var tests = []struct {
+		name       string
+		streamName string
+		query      string
+		rows       func(sqlmock.Sqlmock) *sqlmock.Rows
+		want       int
+	}{
+		{"stream", "stream-1", "stream_version", func(mock sqlmock.Sqlmock) *sqlmock.Rows {
+			return mock.NewRows([]string{"stream_version"}).AddRow(4)
+		}, 5},
+		{"empty stream", "stream-1", "stream_version", func(mock sqlmock.Sqlmock) *sqlmock.Rows {
+			return mock.NewRows([]string{"stream_version"}).AddRow(nil)
+		}, 0},
+		{"category", "stream", "count", func(mock sqlmock.Sqlmock) *sqlmock.Rows {
+			return mock.NewRows([]string{"count"}).AddRow(42)
+		}, 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery(tt.query).
+				WithArgs(tt.streamName).
+				WillReturnRows(tt.rows(mock))
+
+			count, err := messagedb.New(db).MessageCount(tt.streamName)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when counting messages", err)
+			}
+			if count != tt.want {
+				t.Errorf("got %d messages, want %d", count, tt.want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestWriteRawData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	msg := messagedb.NewMessage("stream-1", "type")
+	msg.RawData = []byte(`"AAEC"`)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(msg.ID, msg.StreamName, msg.Type, msg.RawData, []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db)
+
+	if _, err := m.Write(msg); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	invalid := messagedb.NewMessage("stream-1", "type")
+	invalid.RawData = []byte{0, 1, 2}
+	if _, err := m.Write(invalid); err != messagedb.ErrInvalidRawData {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrInvalidRawData)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadRawData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 0, 1, []byte(`"AAEC"`), nil, time.Now()).
+			AddRow(uuid.New(), streamName, "type", 1, 2, []byte(`{"key":"value"}`), nil, time.Now()))
+
+	msgs, err := messagedb.New(db).Read(streamName, 0, 2)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading", err)
+	}
+
+	if string(msgs[0].RawData) != `"AAEC"` || msgs[0].Data != nil {
+		t.Errorf("got raw data %s and data %v, want raw data \"AAEC\" and no data", msgs[0].RawData, msgs[0].Data)
+	}
+	if string(msgs[1].RawData) != `{"key":"value"}` || msgs[1].Data["key"] != "value" {
+		t.Errorf("got raw data %s and data %v, want both to hold the object", msgs[1].RawData, msgs[1].Data)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteSequence(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+	msgs := messagedb.Messages{
+		messagedb.NewMessage("", "first"),
+		messagedb.NewMessage("", "second"),
+		messagedb.NewMessage("", "third"),
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(msgs[0].ID, streamName, "first", sqlmock.AnyArg(), sqlmock.AnyArg(), 4).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("5"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(msgs[1].ID, streamName, "second", sqlmock.AnyArg(), sqlmock.AnyArg(), 5).
+		WillReturnError(errors.New("Wrong expected version: 5 (Stream: stream-1, Stream Version: 6)"))
+	mock.ExpectRollback()
+
+	written, err := messagedb.New(db).WriteSequence(streamName, 4, msgs)
+	if written != 1 {
+		t.Errorf("got %d messages written, want 1", written)
+	}
+	if conflict, ok := err.(messagedb.ErrVersionConflict); !ok || conflict.ActualVersion != 6 {
+		t.Errorf("got %v, want version conflict at version 6", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadAllContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msgs, err := messagedb.New(db).ReadAllContext(ctx, "readall")
+	if err != context.Canceled {
+		t.Errorf("got %v, want error %s", err, context.Canceled)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("expected 0 messages, got %d", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadRowError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	// The connection drops after the first row, which must not read as the
+	// end of the stream.
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs("account-1", 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Opened", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, nil, time.Now()).
+			RowError(1, errConnectionReset))
+
+	if _, err := messagedb.New(db).ReadAll("account-1"); !errors.Is(err, errConnectionReset) {
+		t.Errorf("got %v, want error %s", err, errConnectionReset)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "replay"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	firstPage := mock.NewRows(columns)
+	for i := 0; i < 1000; i++ {
+		firstPage.AddRow(uuid.New(), "replay-1", "type", i, 10+i*2, nil, nil, time.Now())
+	}
+	secondPage := mock.NewRows(columns)
+	for i := 1000; i < 1005; i++ {
+		secondPage.AddRow(uuid.New(), "replay-1", "type", i, 10+i*2, nil, nil, time.Now())
+	}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 10, 1000).
+		WillReturnRows(firstPage)
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2009, 1000).
+		WillReturnRows(secondPage)
+
+	m := messagedb.New(db)
+
+	handlerErr := errors.New("handler failed")
+	handled := 0
+	lastPosition, err := m.Replay(streamName, 10, func(msg *messagedb.Message) error {
+		if msg.Position == 1003 {
+			return handlerErr
+		}
+		handled++
+		return nil
+	})
+	if err != handlerErr {
+		t.Errorf("got %v, want error %s", err, handlerErr)
+	}
+	if handled != 1003 {
+		t.Errorf("got %d messages handled, want 1003", handled)
+	}
+	if want := 10 + 1002*2; lastPosition != want {
+		t.Errorf("got last position %d, want %d", lastPosition, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadAllWithBlockSize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), streamName, "type", 1, 2, nil, nil, time.Now()))
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 2, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 2, 3, nil, nil, time.Now()))
+
+	msgs, err := messagedb.New(db, messagedb.WithBlockSize(2)).ReadAll(streamName)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading all", err)
+	}
+
+	if len(msgs) != 3 {
+		t.Errorf("expected 3 messages, got %d", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+	readErr := errors.New("read failed")
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 5, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 5, 10, nil, nil, time.Now()).
+			AddRow(uuid.New(), streamName, "type", 6, 11, nil, nil, time.Now()))
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 7, 2).
+		WillReturnError(readErr)
+
+	var positions []int
+	var errs []error
+	for msg, err := range messagedb.New(db, messagedb.WithBlockSize(2)).Stream(streamName, 5) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		positions = append(positions, msg.Position)
+	}
+
+	if fmt.Sprint(positions) != "[5 6]" {
+		t.Errorf("got positions %v, want [5 6]", positions)
+	}
+	if len(errs) != 1 || errs[0] != readErr {
+		t.Errorf("got errors %v, want [%s]", errs, readErr)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteManyErrWrite(t *testing.T) {
+	var tests = []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		write  func(m messagedb.MessageDB) error
+		want   string
+	}{
+		{"WriteMany begin", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin().WillReturnError(errConnectionReset)
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.WriteMany("account-1", nil, messagedb.Messages{messagedb.NewMessage("", "Opened"), messagedb.NewMessage("", "Deposited")})
+			return err
+		}, "Opened"},
+		{"WriteMany commit", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+			mock.ExpectQuery("write_message").WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+			mock.ExpectCommit().WillReturnError(errConnectionReset)
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.WriteMany("account-1", nil, messagedb.Messages{messagedb.NewMessage("", "Opened"), messagedb.NewMessage("", "Deposited")})
+			return err
+		}, "Deposited"},
+		{"WriteMany rollback", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").WillReturnError(sql.ErrConnDone)
+			mock.ExpectRollback().WillReturnError(errConnectionReset)
+		}, func(m messagedb.MessageDB) error {
+			_, err := m.WriteMany("account-1", nil, messagedb.Messages{messagedb.NewMessage("", "Opened"), messagedb.NewMessage("", "Deposited")})
+			return err
+		}, "Opened"},
+		{"ResetSubscribers begin", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin().WillReturnError(errConnectionReset)
+		}, func(m messagedb.MessageDB) error {
+			return m.ResetSubscribers([]string{"a", "b"})
+		}, messagedb.PositionMessageType},
+		{"ResetSubscribers commit", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+			mock.ExpectCommit().WillReturnError(errConnectionReset)
+		}, func(m messagedb.MessageDB) error {
+			return m.ResetSubscribers([]string{"a"})
+		}, messagedb.PositionMessageType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tt.expect(mock)
+
+			err = tt.write(messagedb.New(db))
+			var writeErr messagedb.ErrWrite
+			if !errors.As(err, &writeErr) || !errors.Is(err, errConnectionReset) {
+				t.Fatalf("got %v, want an ErrWrite wrapping %s", err, errConnectionReset)
+			}
+			if writeErr.Message.Type != tt.want {
+				t.Errorf("got message of type %s, want %s", writeErr.Message.Type, tt.want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestWriteMany(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+	expectedVersion := 2
+	next := func(position string) *sqlmock.Rows {
+		return mock.NewRows([]string{"next_position"}).FromCSVString(position)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "first", sqlmock.AnyArg(), sqlmock.AnyArg(), 2).
+		WillReturnRows(next("3"))
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "second", sqlmock.AnyArg(), sqlmock.AnyArg(), 3).
+		WillReturnRows(next("4"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "first", sqlmock.AnyArg(), sqlmock.AnyArg(), 2).
+		WillReturnRows(next("3"))
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "second", sqlmock.AnyArg(), sqlmock.AnyArg(), 3).
+		WillReturnError(errors.New("Wrong expected version: 3 (Stream: stream-1, Stream Version: 4)"))
+	mock.ExpectRollback()
+
+	m := messagedb.New(db)
+
+	msgs := func() messagedb.Messages {
+		return messagedb.Messages{messagedb.NewMessage("", "first"), messagedb.NewMessage("", "second")}
+	}
+
+	position, err := m.WriteMany(streamName, &expectedVersion, msgs())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when writing many", err)
+	}
+	if position != 4 {
+		t.Errorf("got position %d, want 4", position)
+	}
+
+	if _, err = m.WriteMany(streamName, &expectedVersion, msgs()); !errors.As(err, &messagedb.ErrVersionConflict{}) {
+		t.Errorf("got %v, want error version conflict", err)
+	}
+
+	if _, err = m.WriteMany(streamName, nil, messagedb.Messages{messagedb.NewMessage("", "")}); err != messagedb.ErrTypeRequired {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrTypeRequired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSchemaNotInstalled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	undefined := &pgconn.PgError{Code: "42883", Message: "function get_stream_messages(unknown, integer, integer) does not exist"}
+
+	noSchema := func() {
+		mock.ExpectQuery("pg_proc").
+			WillReturnRows(mock.NewRows([]string{"nspname"}))
+	}
+
+	mock.ExpectQuery("get_stream_messages").
+		WillReturnError(undefined)
+	noSchema()
+	mock.ExpectQuery("get_last_stream_message").
+		WillReturnError(undefined)
+	noSchema()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnError(undefined)
+	mock.ExpectRollback()
+	noSchema()
+
+	m := messagedb.New(db)
+
+	_, readErr := m.Read("stream-1", 0, 10)
+	_, lastErr := m.ReadLast("stream-1")
+	_, writeErr := m.Write(messagedb.NewMessage("stream-1", "type"))
+
+	for _, err := range []error{readErr, lastErr, writeErr} {
+		var notInstalled messagedb.ErrSchemaNotInstalled
+		if !errors.As(err, &notInstalled) || !errors.Is(err, undefined) {
+			t.Errorf("got %v, want error schema not installed", err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSearchPathNotSet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	undefined := &pgconn.PgError{Code: "42883", Message: "function get_stream_messages(unknown, integer, integer) does not exist"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WillReturnError(undefined)
+	mock.ExpectQuery("pg_proc").
+		WillReturnRows(mock.NewRows([]string{"nspname"}).AddRow("message_store"))
+
+	_, err = messagedb.New(db).Read("stream-1", 0, 10)
+
+	var notSet messagedb.ErrSearchPathNotSet
+	if !errors.As(err, &notSet) || notSet.Schema != "message_store" || !errors.Is(err, undefined) {
+		t.Errorf("got %v, want error search path not set", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), subscriberStreamName, "Read", 3, 3, []byte(`{"position":7,"globalPosition":42}`), nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 43, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 8, 43, nil, nil, time.Now()).
+			AddRow(uuid.New(), "stream-1", "type", 9, 45, nil, nil, time.Now()))
+
+	msgs, err := messagedb.New(db).Peek(streamName, subscriberID, 2)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when peeking", err)
+	}
+	if len(msgs) != 2 || msgs[0].GlobalPosition != 43 {
+		t.Errorf("got %d messages, want 2 from global position 43", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 3).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 0, 1, []byte(`{"a":1}`), []byte(`{"schemaVersion":2}`), time.Now()).
+			AddRow(uuid.New(), streamName, "type", 1, 2, []byte(`{"b":2}`), nil, time.Now()).
+			AddRow(uuid.New(), streamName, "type", 2, 3, nil, nil, time.Now()))
+
+	var got []string
+	msg := &messagedb.Message{}
+	err = messagedb.New(db).ReadInto(streamName, 0, 3, msg, func(msg *messagedb.Message) error {
+		got = append(got, fmt.Sprintf("%d %s %v %d", msg.Position, msg.RawData, msg.Data, msg.SchemaVersion()))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading into", err)
+	}
+
+	want := []string{"0 {\"a\":1} map[a:1] 2", "1 {\"b\":2} map[b:2] 0", "2  map[] 0"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func benchmarkRows(mock sqlmock.Sqlmock, streamName string, n int) *sqlmock.Rows {
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+	rows := mock.NewRows(columns)
+	for i := 0; i < n; i++ {
+		rows.AddRow(uuid.New().String(), streamName, "type", i, i+1, []byte(`{"amount":10,"currency":"USD"}`), []byte(`{"correlationStreamName":"transfer-1"}`), time.Now())
+	}
+	return rows
+}
+
+func BenchmarkRead(b *testing.B) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+	m := messagedb.New(db)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectQuery("get_stream_messages").WillReturnRows(benchmarkRows(mock, streamName, 1000))
+		b.StartTimer()
+
+		if _, err := m.Read(streamName, 0, 1000); err != nil {
+			b.Fatalf("unexpected error '%s' when reading", err)
+		}
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream-1"
+	m := messagedb.New(db)
+	msg := &messagedb.Message{}
+	handle := func(*messagedb.Message) error { return nil }
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectQuery("get_stream_messages").WillReturnRows(benchmarkRows(mock, streamName, 1000))
+		b.StartTimer()
+
+		if err := m.ReadInto(streamName, 0, 1000, msg, handle); err != nil {
+			b.Fatalf("unexpected error '%s' when reading", err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	m := messagedb.New(db)
+	data := map[string]interface{}{"amount": 10, "currency": "USD"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectBegin()
+		mock.ExpectQuery("write_message").
+			WillReturnRows(mock.NewRows([]string{"next_position"}).AddRow(i))
+		mock.ExpectCommit()
+		msg := messagedb.NewMessage("stream-1", "type")
+		msg.Data = data
+		b.StartTimer()
+
+		if _, err := m.Write(msg); err != nil {
+			b.Fatalf("unexpected error '%s' when writing", err)
+		}
+	}
+}
+
+func TestReadUpTo(t *testing.T) {
+	var tests = []struct {
+		name    string
+		version int
+		// batch is the batch size of the first read, and rows how many
+		// messages it returns
+		batch int
+		rows  int
+		want  int
+	}{
+		{"within stream", 4, 5, 5, 5},
+		{"past end of stream", 2000, 1000, 7, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "stream-1"
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			rows := mock.NewRows(columns)
+			for i := 0; i < tt.rows; i++ {
+				rows.AddRow(uuid.New(), streamName, "type", i, i+1, nil, nil, time.Now())
+			}
+
+			mock.ExpectQuery("get_stream_messages").
+				WithArgs(streamName, 0, tt.batch).
+				WillReturnRows(rows)
+
+			msgs, err := messagedb.New(db).ReadUpTo(streamName, tt.version)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when reading up to version", err)
+			}
+			if len(msgs) != tt.want {
+				t.Errorf("expected %d messages, got %d", tt.want, len(msgs))
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestWriteWithCanonicalJSON(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	msg := messagedb.NewMessage("stream-1", "type")
+	msg.RawData = []byte(`{ "z": "<tag>", "a": 1 }`)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(msg.ID, msg.StreamName, msg.Type, []uint8(`{"a":1,"z":"<tag>"}`), []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	if _, err := messagedb.New(db, messagedb.WithCanonicalJSON()).Write(msg); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadCategoryForCardinal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("account", 5, 3).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-tenant1+1", "type", 0, 5, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-tenant2+1", "type", 0, 6, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-tenant1", "type", 0, 8, nil, nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("account", 9, 3).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-tenant2+2", "type", 0, 9, nil, nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("account", 10, 3).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	var got []int
+	position := 5
+	for {
+		msgs, next, err := m.ReadCategoryForCardinal("account", "tenant1", position, 3)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when reading category for cardinal", err)
+		}
+		for _, msg := range msgs {
+			got = append(got, msg.GlobalPosition)
+		}
+		if next == position {
+			break
+		}
+		position = next
+	}
+
+	if want := []int{5, 8}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got global positions %v, want %v", got, want)
+	}
+	if position != 10 {
+		t.Errorf("got position %d, want 10", position)
+	}
+
+	if _, _, err := m.ReadCategoryForCardinal("account-1", "tenant1", 0, 3); err != messagedb.ErrInvalidCategory {
+		t.Errorf("got %v, want %s", err, messagedb.ErrInvalidCategory)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestValidateWrite(t *testing.T) {
+	tooOld := -2
+	var tests = []struct {
+		name  string
+		build func(msg *messagedb.Message)
+		err   error
+	}{
+		{"valid", func(msg *messagedb.Message) {}, nil},
+		{"missing stream name", func(msg *messagedb.Message) { msg.StreamName = "" }, messagedb.ErrStreamNameRequired},
+		{"missing type", func(msg *messagedb.Message) { msg.Type = "" }, messagedb.ErrTypeRequired},
+		{"invalid expected version", func(msg *messagedb.Message) { msg.ExpectedVersion = &tooOld }, messagedb.ErrInvalidExpectedVersion},
+		{"invalid raw data", func(msg *messagedb.Message) { msg.RawData = []byte("{") }, messagedb.ErrInvalidRawData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &messagedb.Message{StreamName: "stream-1", Type: "type"}
+			tt.build(msg)
+
+			if err := messagedb.ValidateWrite(msg); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if msg.ID != "" {
+				t.Errorf("got id %s, want none", msg.ID)
+			}
+		})
+	}
+
+	msg := messagedb.NewMessage("stream-1", "type")
+	msg.Data = map[string]interface{}{"ch": make(chan int)}
+	if err := messagedb.ValidateWrite(msg); err == nil {
+		t.Error("got no error for data that cannot be marshaled")
+	}
+}
+
+func TestWriteIf(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "Deposited", 0, 1, []byte(`{"amount":15}`), nil, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "Withdrawn", sqlmock.AnyArg(), sqlmock.AnyArg(), 0).
+		WillReturnError(errors.New("Wrong expected version: 0 (Stream: account-1, Stream Version: 1)"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "Deposited", 0, 1, []byte(`{"amount":15}`), nil, time.Now()).
+			AddRow(uuid.New(), streamName, "Deposited", 1, 2, []byte(`{"amount":5}`), nil, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), streamName, "Withdrawn", sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("2"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(streamName, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "Deposited", 0, 1, []byte(`{"amount":10}`), nil, time.Now()))
+
+	// canWithdraw allows a withdrawal of amount when the balance covers it.
+	canWithdraw := func(amount float64) func(messagedb.Messages) (bool, int) {
+		return func(msgs messagedb.Messages) (bool, int) {
+			balance := 0.0
+			for _, msg := range msgs {
+				balance += msg.Data["amount"].(float64)
+			}
+			return balance >= amount, len(msgs) - 1
+		}
+	}
+
+	m := messagedb.New(db)
+
+	withdraw := messagedb.NewMessage("", "Withdrawn")
+	withdraw.Data = map[string]interface{}{"amount": 12}
+	position, err := m.WriteIf(streamName, canWithdraw(12), withdraw)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when writing if", err)
+	}
+	if position != 2 {
+		t.Errorf("got position %d, want 2", position)
+	}
+
+	withdraw = messagedb.NewMessage("", "Withdrawn")
+	if _, err = m.WriteIf(streamName, canWithdraw(12), withdraw); err != messagedb.ErrConditionNotMet {
+		t.Errorf("got %v, want %s", err, messagedb.ErrConditionNotMet)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	msg := messagedb.NewMessage("account-1", "Opened")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("write_message").
+		WithArgs(msg.ID, msg.StreamName, msg.Type, []uint8("null"), []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when beginning a transaction", err)
+	}
+	if _, err = tx.Exec("INSERT INTO accounts (id) VALUES (1)"); err != nil {
+		t.Fatalf("unexpected error '%s' when inserting", err)
+	}
+	if _, err = messagedb.New(db).WriteTx(tx, msg); err != nil {
+		t.Fatalf("unexpected error '%s' when writing in transaction", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("unexpected error '%s' when committing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadLastCategory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("ORDER BY global_position DESC").
+		WithArgs("account").
+		WillReturnRows(mock.NewRows(columns).AddRow(uuid.New(), "account-2", "Opened", 0, 9, nil, nil, time.Now()))
+
+	m := messagedb.New(db)
+
+	msg, err := m.ReadLastCategory("account")
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading last of category", err)
+	}
+	if msg.GlobalPosition != 9 {
+		t.Errorf("got global position %d, want 9", msg.GlobalPosition)
+	}
+
+	if _, err = m.ReadLastCategory("account-1"); err != messagedb.ErrInvalidCategory {
+		t.Errorf("got %v, want %s", err, messagedb.ErrInvalidCategory)
+	}
+	if _, err = m.ReadLast("account"); err != messagedb.ErrEntityStreamRequired {
+		t.Errorf("got %v, want %s", err, messagedb.ErrEntityStreamRequired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteWithIsolationLevel(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db, messagedb.WithIsolationLevel(sql.LevelSerializable))
+
+	if _, err := m.Write(messagedb.NewMessage("stream-1", "type")); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteWithMaxPayloadBytes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	m := messagedb.New(db, messagedb.WithMaxPayloadBytes(16))
+
+	msg := messagedb.NewMessage("stream-1", "type")
+	msg.RawData = []byte(`{"name":"too long by far"}`)
+	if _, err := m.Write(msg); err != (messagedb.ErrPayloadTooLarge{Bytes: 26}) {
+		t.Errorf("got %v, want payload of 26 bytes too large", err)
+	}
+
+	msg = messagedb.NewMessage("stream-1", "type")
+	msg.Metadata = &messagedb.Metadata{CorrelationStreamName: "correlation-1"}
+	if _, err := m.Write(msg); err == nil {
+		t.Error("got no error for metadata larger than the maximum payload")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteContextWithMetadataFromContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	type traceIDKey struct{}
+
+	msg := messagedb.NewMessage("stream-1", "type")
+	msg.Metadata = &messagedb.Metadata{CorrelationStreamName: "order-1"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(msg.ID, msg.StreamName, msg.Type, []uint8("null"), []uint8(`{"correlationStreamName":"order-1","schemaVersion":2,"traceId":"abc"}`), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db, messagedb.WithMetadataFromContext(func(ctx context.Context) map[string]interface{} {
+		return map[string]interface{}{
+			"traceId":               ctx.Value(traceIDKey{}),
+			"correlationStreamName": "tenant-1",
+			"schemaVersion":         2,
+		}
+	}))
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "abc")
+	if _, err := m.WriteContext(ctx, msg); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadStreamWithCondition(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	condition := "messages.type = 'Deposited'"
+
+	mock.ExpectQuery("get_stream_messages\\(\\$1, \\$2, \\$3, \\$4\\)").
+		WithArgs("account-1", 0, 100, condition).
+		WillReturnRows(mock.NewRows(columns).AddRow(uuid.New(), "account-1", "Deposited", 1, 5, nil, nil, time.Now()))
+
+	m := messagedb.New(db)
+
+	msgs, err := m.ReadStream("account-1", 0, 100, condition)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading stream with condition", err)
+	}
+	if len(msgs) != 1 || msgs[0].Type != "Deposited" {
+		t.Errorf("got %v, want one Deposited message", msgs)
+	}
+
+	if _, err = m.ReadStream("account", 0, 100, condition); err != messagedb.ErrEntityStreamRequired {
+		t.Errorf("got %v, want %s", err, messagedb.ErrEntityStreamRequired)
+	}
+	if _, err = m.ReadStream("account-1", 0, 100, "1=1; DROP TABLE messages"); err != messagedb.ErrInvalidCondition {
+		t.Errorf("got %v, want %s", err, messagedb.ErrInvalidCondition)
+	}
+	if _, err = m.ReadCategory("account", 0, 100, messagedb.CategoryFilter{Condition: "1=1 -- x"}); err != messagedb.ErrInvalidCondition {
+		t.Errorf("got %v, want %s", err, messagedb.ErrInvalidCondition)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadWithReadBudget(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "budget"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	firstPage := mock.NewRows(columns)
+	for i := 0; i < 2; i++ {
+		firstPage.AddRow(uuid.New(), "budget-1", "type", i, 5+i, nil, nil, time.Now())
+	}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 0, 2).
+		WillReturnRows(firstPage)
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 7, 2).
+		WillDelayFor(time.Second).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db, messagedb.WithBlockSize(2), messagedb.WithReadBudget(50*time.Millisecond))
+
+	msgs, err := m.ReadAll(streamName)
+	var budgetErr messagedb.ErrReadBudgetExceeded
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("got %v, want ErrReadBudgetExceeded", err)
+	}
+	if budgetErr.Read != 2 || budgetErr.Position != 7 {
+		t.Errorf("got read %d and position %d, want 2 and 7", budgetErr.Read, budgetErr.Position)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("got %d messages, want 2", len(msgs))
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want it to wrap %s", err, context.DeadlineExceeded)
+	}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 5, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "budget-1", "type", 0, 5, nil, nil, time.Now()).
+			AddRow(uuid.New(), "budget-1", "type", 1, 6, nil, nil, time.Now()))
+
+	handled := 0
+	lastPosition, err := m.Replay(streamName, 5, func(msg *messagedb.Message) error {
+		handled++
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("got %v, want ErrReadBudgetExceeded", err)
+	}
+	if handled != 1 || lastPosition != 5 || budgetErr.Read != 1 || budgetErr.Position != 6 {
+		t.Errorf("got %d handled to %d and error %+v, want 1 handled to 5 resuming from 6", handled, lastPosition, budgetErr)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadByID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	id := uuid.New()
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs("account-1", 0, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Opened", 0, 3, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 7, nil, nil, time.Now()))
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs("account-1", 2, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(id, "account-1", "Withdrawn", 2, 9, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 3, 12, nil, nil, time.Now()))
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs("account-2", 0, 2).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-2", "Opened", 0, 4, nil, nil, time.Now()))
+
+	m := messagedb.New(db, messagedb.WithBlockSize(2))
+
+	msg, err := m.ReadByID("account-1", id.String())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading by id", err)
+	}
+	if msg == nil || msg.Type != "Withdrawn" {
+		t.Errorf("got %v, want the Withdrawn message", msg)
+	}
+
+	msg, err = m.ReadByID("account-2", id.String())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading by id", err)
+	}
+	if msg != nil {
+		t.Errorf("got %v, want nil", msg)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteWithSchemaVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var tests = []struct {
+		name     string
+		msgType  string
+		metadata *messagedb.Metadata
+		want     string
+	}{
+		{"stamped", "Deposited", nil, `{"schemaVersion":2}`},
+		{"own version", "Deposited", &messagedb.Metadata{SchemaVersion: 1}, `{"schemaVersion":1}`},
+		{"unregistered", "Withdrawn", nil, "null"},
+	}
+
+	m := messagedb.New(db, messagedb.WithSchemaVersion("Deposited", 2))
+
+	for _, test := range tests {
+		msg := messagedb.NewMessage("account-1", test.msgType)
+		msg.Metadata = test.metadata
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("write_message").
+			WithArgs(msg.ID, msg.StreamName, msg.Type, []uint8("null"), []uint8(test.want), nil).
+			WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+		mock.ExpectCommit()
+
+		if _, err := m.Write(msg); err != nil {
+			t.Errorf("%s: unexpected error '%s' when writing", test.name, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteReturnsStreamVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	m := messagedb.New(db)
+
+	version := -1
+	for i := 0; i < 3; i++ {
+		msg := messagedb.NewMessage("account-1", "Deposited")
+		expectedVersion := version
+		msg.ExpectedVersion = &expectedVersion
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("write_message").
+			WithArgs(msg.ID, msg.StreamName, msg.Type, sqlmock.AnyArg(), sqlmock.AnyArg(), version).
+			WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString(fmt.Sprint(version + 1)))
+		mock.ExpectCommit()
+
+		if version, err = m.Write(msg); err != nil {
+			t.Fatalf("unexpected error '%s' when writing at version %d", err, expectedVersion)
+		}
+		if version != i {
+			t.Errorf("got version %d, want %d", version, i)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	var tests = []struct {
+		streamName string
+		query      string
+		rows       *sqlmock.Rows
+		next       int
+	}{
+		{"account-1", "get_stream_messages", mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 4, 20, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 5, 31, nil, nil, time.Now()), 6},
+		{"account", "get_category_messages", mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 4, 20, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 31, nil, nil, time.Now()), 32},
+		{"account", "get_category_messages", mock.NewRows(columns), 4},
+	}
+
+	m := messagedb.New(db)
+
+	for _, test := range tests {
+		mock.ExpectQuery(test.query).
+			WithArgs(test.streamName, 4, 2).
+			WillReturnRows(test.rows)
+
+		_, next, err := m.ReadPage(test.streamName, 4, 2)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when reading page of %s", err, test.streamName)
+		}
+		if next != test.next {
+			t.Errorf("%s: got next position %d, want %d", test.streamName, next, test.next)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestNewReadWrite(t *testing.T) {
+	writeDB, writeMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer writeDB.Close()
+	readDB, readMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer readDB.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	readMock.ExpectQuery("get_stream_messages").
+		WithArgs("account-1", 0, 10).
+		WillReturnRows(readMock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Opened", 0, 1, nil, nil, time.Now()))
+
+	writeMock.ExpectBegin()
+	writeMock.ExpectQuery("write_message").
+		WillReturnRows(writeMock.NewRows([]string{"next_position"}).FromCSVString("1"))
+	writeMock.ExpectCommit()
+
+	// WriteIf folds the stream as read from the primary.
+	writeMock.ExpectQuery("get_stream_messages").
+		WithArgs("account-1", 0, 1000).
+		WillReturnRows(writeMock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Opened", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, nil, time.Now()))
+	writeMock.ExpectBegin()
+	writeMock.ExpectQuery("write_message").
+		WillReturnRows(writeMock.NewRows([]string{"next_position"}).FromCSVString("2"))
+	writeMock.ExpectCommit()
+
+	m := messagedb.NewReadWrite(writeDB, readDB)
+
+	if _, err := m.Read("account-1", 0, 10); err != nil {
+		t.Fatalf("unexpected error '%s' when reading", err)
+	}
+	if _, err := m.Write(messagedb.NewMessage("account-1", "Deposited")); err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+	_, err = m.WriteIf("account-1", func(msgs messagedb.Messages) (bool, int) {
+		return true, len(msgs) - 1
+	}, messagedb.NewMessage("account-1", "Withdrawn"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when writing conditionally", err)
+	}
+
+	if err := readMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet read expectations: %s", err)
+	}
+	if err := writeMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet write expectations: %s", err)
+	}
+}
+
+func TestWithWriteInterceptor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var calls []string
+	record := func(name string) func(messagedb.WriteFunc) messagedb.WriteFunc {
+		return func(next messagedb.WriteFunc) messagedb.WriteFunc {
+			return func(ctx context.Context, msg *messagedb.Message) (int, error) {
+				calls = append(calls, name+" before")
+				position, err := next(ctx, msg)
+				calls = append(calls, fmt.Sprintf("%s after %d", name, position))
+				return position, err
+			}
+		}
+	}
+	errRejected := errors.New("rejected")
+	validate := func(next messagedb.WriteFunc) messagedb.WriteFunc {
+		return func(ctx context.Context, msg *messagedb.Message) (int, error) {
+			if msg.Type == "Forbidden" {
+				return 0, errRejected
+			}
+			msg.Data = map[string]interface{}{"enriched": true}
+			return next(ctx, msg)
+		}
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "account-1", "Opened", []uint8(`{"enriched":true}`), []uint8("null"), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("4"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db, messagedb.WithWriteInterceptor(record("outer")), messagedb.WithWriteInterceptor(record("inner")), messagedb.WithWriteInterceptor(validate))
+
+	position, err := m.Write(messagedb.NewMessage("account-1", "Opened"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when writing", err)
+	}
+	if position != 4 {
+		t.Errorf("got position %d, want 4", position)
+	}
+	want := []string{"outer before", "inner before", "inner after 4", "outer after 4"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+
+	if _, err := m.Write(messagedb.NewMessage("account-1", "Forbidden")); err != errRejected {
+		t.Errorf("got %v, want error %s", err, errRejected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestReadCategoryFromGlobal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("account", 8, 10).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 3, 8, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 12, nil, nil, time.Now()))
+
+	m := messagedb.New(db)
+
+	msgs, err := m.ReadCategoryFromGlobal("account", 7, 10)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading category", err)
+	}
+	if len(msgs) != 2 || msgs[0].GlobalPosition != 8 || msgs[1].GlobalPosition != 12 {
+		t.Errorf("got %v, want the messages after global position 7", msgs)
+	}
+
+	if _, err := m.ReadCategoryFromGlobal("account-1", 7, 10); err != messagedb.ErrInvalidCategory {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrInvalidCategory)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
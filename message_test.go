@@ -1,6 +1,7 @@
 package messagedb_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/brycedarling/messagedb"
@@ -21,3 +22,110 @@ func TestNewMessage(t *testing.T) {
 		t.Errorf("got %s, want %s", msg.Type, messageType)
 	}
 }
+
+func TestNewMessageValidated(t *testing.T) {
+	var tests = []struct {
+		streamName  string
+		messageType string
+		err         error
+	}{
+		{"account-123", "Deposited", nil},
+		{"account", "Deposited", nil},
+		{"", "Deposited", messagedb.ErrStreamNameRequired},
+		{"-123", "Deposited", messagedb.ErrCategoryRequired},
+		{"account-", "Deposited", messagedb.ErrStreamIDRequired},
+		{"account-123", "", messagedb.ErrTypeRequired},
+	}
+
+	for _, tt := range tests {
+		msg, err := messagedb.NewMessageValidated(tt.streamName, tt.messageType)
+		if err != tt.err {
+			t.Errorf("%q %q: got error %v, want %v", tt.streamName, tt.messageType, err, tt.err)
+		}
+		if err == nil && (msg.ID == "" || msg.StreamName != tt.streamName || msg.Type != tt.messageType) {
+			t.Errorf("%q %q: got %+v", tt.streamName, tt.messageType, msg)
+		}
+	}
+}
+
+func TestMessageMetadataAccessors(t *testing.T) {
+	msg := messagedb.NewMessage("stream", "type")
+
+	if got := msg.CorrelationStreamName(); got != "" {
+		t.Errorf("got %s, want empty correlation stream name", got)
+	}
+
+	msg.Metadata = &messagedb.Metadata{
+		CorrelationStreamName:          "transfer-1",
+		CausationMessageStreamName:     "account-1",
+		CausationMessagePosition:       3,
+		CausationMessageGlobalPosition: 42,
+		ReplyStreamName:                "reply-1",
+		SchemaVersion:                  2,
+	}
+
+	if got := msg.CorrelationStreamName(); got != "transfer-1" {
+		t.Errorf("got %s, want %s", got, "transfer-1")
+	}
+	if got := msg.CausationMessageStreamName(); got != "account-1" {
+		t.Errorf("got %s, want %s", got, "account-1")
+	}
+	if got := msg.CausationMessagePosition(); got != 3 {
+		t.Errorf("got %d, want %d", got, 3)
+	}
+	if got := msg.CausationMessageGlobalPosition(); got != 42 {
+		t.Errorf("got %d, want %d", got, 42)
+	}
+	if got := msg.ReplyStreamName(); got != "reply-1" {
+		t.Errorf("got %s, want %s", got, "reply-1")
+	}
+	if got := msg.SchemaVersion(); got != 2 {
+		t.Errorf("got %d, want %d", got, 2)
+	}
+}
+
+func TestMessagesGroupByStream(t *testing.T) {
+	msgs := messagedb.Messages{
+		{StreamName: "account-1", GlobalPosition: 1},
+		{StreamName: "account-2", GlobalPosition: 2},
+		{StreamName: "account-1", GlobalPosition: 3},
+	}
+
+	streams := msgs.GroupByStream()
+
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(streams))
+	}
+	if got := streams["account-1"]; len(got) != 2 || got[0].GlobalPosition != 1 || got[1].GlobalPosition != 3 {
+		t.Errorf("got %v for account-1, want global positions 1 and 3", got)
+	}
+	if got := streams["account-2"]; len(got) != 1 || got[0].GlobalPosition != 2 {
+		t.Errorf("got %v for account-2, want global position 2", got)
+	}
+}
+
+func TestMessageCorrelate(t *testing.T) {
+	msg := messagedb.NewMessage("transfer:command-1", "Withdraw")
+
+	if err := msg.Correlate("account-1"); err != nil {
+		t.Fatalf("unexpected error '%s' when correlating", err)
+	}
+	if got := msg.CorrelationStreamName(); got != "account-1" {
+		t.Errorf("got %s, want correlation stream name account-1", got)
+	}
+
+	if err := msg.Correlate("-1"); err != messagedb.ErrCategoryRequired {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrCategoryRequired)
+	}
+	if got := msg.CorrelationStreamName(); got != "account-1" {
+		t.Errorf("got %s, want correlation stream name left as account-1", got)
+	}
+
+	data, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when marshaling metadata", err)
+	}
+	if want := `{"correlationStreamName":"account-1"}`; string(data) != want {
+		t.Errorf("got metadata %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,82 @@
+// Package messagedbtest sets up go-sqlmock expectations for the queries a
+// messagedb.MessageDB runs, so tests of code built on messagedb can stub the
+// store without matching its SQL by hand.
+package messagedbtest
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+)
+
+// Columns are the columns of the rows returned by the message-db functions
+// that read messages.
+var Columns = []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+// Rows returns the rows that read msgs, with their data and metadata
+// marshaled to JSON.
+func Rows(mock sqlmock.Sqlmock, msgs ...*messagedb.Message) (*sqlmock.Rows, error) {
+	rows := mock.NewRows(Columns)
+	for _, msg := range msgs {
+		data := msg.RawData
+		if data == nil && msg.Data != nil {
+			var err error
+			if data, err = json.Marshal(msg.Data); err != nil {
+				return nil, err
+			}
+		}
+		var metadata []byte
+		if msg.Metadata != nil {
+			var err error
+			if metadata, err = json.Marshal(msg.Metadata); err != nil {
+				return nil, err
+			}
+		}
+		rows.AddRow(msg.ID, msg.StreamName, msg.Type, msg.Position, msg.GlobalPosition, data, metadata, msg.Time)
+	}
+	return rows, nil
+}
+
+// ExpectLastMessage expects ReadLast of streamName.
+func ExpectLastMessage(mock sqlmock.Sqlmock, streamName string) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(regexp.QuoteMeta(messagedb.LastStreamMessageSQL)).
+		WithArgs(streamName)
+}
+
+// ExpectCategoryMessages expects a read of batchSize messages of category
+// from position.
+func ExpectCategoryMessages(mock sqlmock.Sqlmock, category string, position, batchSize int) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(regexp.QuoteMeta(messagedb.CategoryMessagesSQL)).
+		WithArgs(category, position, batchSize)
+}
+
+// ExpectStreamMessages expects a read of batchSize messages of the entity
+// stream from position.
+func ExpectStreamMessages(mock sqlmock.Sqlmock, streamName string, position, batchSize int) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(regexp.QuoteMeta(messagedb.StreamMessagesSQL)).
+		WithArgs(streamName, position, batchSize)
+}
+
+// ExpectWrite expects a successful Write returning nextPosition. args, when
+// given, are matched against the id, stream name, type, data, metadata and
+// expected version written.
+func ExpectWrite(mock sqlmock.Sqlmock, nextPosition int, args ...driver.Value) {
+	mock.ExpectBegin()
+	query := mock.ExpectQuery(regexp.QuoteMeta(messagedb.WriteMessageSQL))
+	if len(args) > 0 {
+		query.WithArgs(args...)
+	}
+	query.WillReturnRows(mock.NewRows([]string{"next_position"}).AddRow(nextPosition))
+	mock.ExpectCommit()
+}
+
+// ExpectWriteError expects a Write that fails with err and is rolled back.
+func ExpectWriteError(mock sqlmock.Sqlmock, err error) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(messagedb.WriteMessageSQL)).
+		WillReturnError(err)
+	mock.ExpectRollback()
+}
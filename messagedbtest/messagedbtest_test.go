@@ -0,0 +1,62 @@
+package messagedbtest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/brycedarling/messagedb/messagedbtest"
+)
+
+func TestExpectations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	msg := messagedb.NewMessage("account-1", "Opened")
+	msg.Data = map[string]interface{}{"owner": "someone"}
+	msg.Metadata = &messagedb.Metadata{SchemaVersion: 2}
+	msg.GlobalPosition = 3
+	msg.Time = time.Now()
+
+	rows, err := messagedbtest.Rows(mock, msg)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when building rows", err)
+	}
+	messagedbtest.ExpectLastMessage(mock, "account-1").WillReturnRows(rows)
+	messagedbtest.ExpectCategoryMessages(mock, "account", 1, 10).WillReturnRows(mock.NewRows(messagedbtest.Columns))
+	messagedbtest.ExpectStreamMessages(mock, "account-1", 0, 10).WillReturnRows(mock.NewRows(messagedbtest.Columns))
+	messagedbtest.ExpectWrite(mock, 1, sqlmock.AnyArg(), "account-1", "Deposited", sqlmock.AnyArg(), sqlmock.AnyArg(), nil)
+	writeErr := errors.New("write failed")
+	messagedbtest.ExpectWriteError(mock, writeErr)
+
+	m := messagedb.New(db)
+
+	last, err := m.ReadLast("account-1")
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when reading last", err)
+	}
+	if last.ID != msg.ID || last.Data["owner"] != "someone" || last.SchemaVersion() != 2 {
+		t.Errorf("got %+v, want %+v", last, msg)
+	}
+	if _, err = m.Read("account", 1, 10); err != nil {
+		t.Errorf("unexpected error '%s' when reading category", err)
+	}
+	if _, err = m.Read("account-1", 0, 10); err != nil {
+		t.Errorf("unexpected error '%s' when reading stream", err)
+	}
+	if position, err := m.Write(messagedb.NewMessage("account-1", "Deposited")); err != nil || position != 1 {
+		t.Errorf("got position %d and error %v, want position 1", position, err)
+	}
+	if _, err = m.Write(messagedb.NewMessage("account-1", "Deposited")); !errors.Is(err, writeErr) {
+		t.Errorf("got %v, want error %s", err, writeErr)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
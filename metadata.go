@@ -0,0 +1,156 @@
+package messagedb
+
+import (
+	"encoding/json"
+	"math"
+)
+
+const (
+	correlationStreamNameKey          string = "correlationStreamName"
+	causationMessageStreamNameKey     string = "causationMessageStreamName"
+	causationMessagePositionKey       string = "causationMessagePosition"
+	causationMessageGlobalPositionKey string = "causationMessageGlobalPosition"
+	replyStreamNameKey                string = "replyStreamName"
+	schemaVersionKey                  string = "schemaVersion"
+)
+
+// Metadata holds the conventional message metadata fields. Any other keys are
+// kept in Extra so that metadata written by other clients round-trips intact,
+// as are conventional keys whose values the fields cannot carry back: an
+// empty stream name, a schemaVersion of 0, or a causation position without a
+// causation stream name.
+type Metadata struct {
+	CorrelationStreamName          string
+	CausationMessageStreamName     string
+	CausationMessagePosition       int
+	CausationMessageGlobalPosition int
+	ReplyStreamName                string
+	SchemaVersion                  int
+	Extra                          map[string]interface{}
+}
+
+// MarshalJSON ...
+func (md Metadata) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(md.Extra)+6)
+	for key, value := range md.Extra {
+		fields[key] = value
+	}
+	if md.CorrelationStreamName != "" {
+		fields[correlationStreamNameKey] = md.CorrelationStreamName
+	}
+	if md.CausationMessageStreamName != "" {
+		fields[causationMessageStreamNameKey] = md.CausationMessageStreamName
+		fields[causationMessagePositionKey] = md.CausationMessagePosition
+		fields[causationMessageGlobalPositionKey] = md.CausationMessageGlobalPosition
+	}
+	if md.ReplyStreamName != "" {
+		fields[replyStreamNameKey] = md.ReplyStreamName
+	}
+	if md.SchemaVersion != 0 {
+		fields[schemaVersionKey] = md.SchemaVersion
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON ...
+func (md *Metadata) UnmarshalJSON(b []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	*md = Metadata{}
+	causation, _ := fields[causationMessageStreamNameKey].(string)
+	for key, value := range fields {
+		if !md.set(key, value, causation != "") {
+			if md.Extra == nil {
+				md.Extra = make(map[string]interface{})
+			}
+			md.Extra[key] = value
+		}
+	}
+	return nil
+}
+
+// set assigns a conventional field, reporting false when the key is not
+// conventional or its value is one MarshalJSON would not write back: of the
+// wrong type, empty, a schema version of 0, or a causation position when the
+// metadata has no causation stream name.
+func (md *Metadata) set(key string, value interface{}, causation bool) bool {
+	switch key {
+	case correlationStreamNameKey:
+		return setString(&md.CorrelationStreamName, value)
+	case causationMessageStreamNameKey:
+		return setString(&md.CausationMessageStreamName, value)
+	case causationMessagePositionKey:
+		return causation && setInt(&md.CausationMessagePosition, value)
+	case causationMessageGlobalPositionKey:
+		return causation && setInt(&md.CausationMessageGlobalPosition, value)
+	case replyStreamNameKey:
+		return setString(&md.ReplyStreamName, value)
+	case schemaVersionKey:
+		return value != float64(0) && setInt(&md.SchemaVersion, value)
+	}
+	return false
+}
+
+func setString(field *string, value interface{}) bool {
+	s, ok := value.(string)
+	if ok && s != "" {
+		*field = s
+	}
+	return ok && s != ""
+}
+
+func setInt(field *int, value interface{}) bool {
+	f, ok := value.(float64)
+	if !ok || f != math.Trunc(f) {
+		return false
+	}
+	*field = int(f)
+	return true
+}
+
+// mergeMetadata fills in the metadata of m that is unset from fields, keyed
+// like the metadata's JSON.
+func (m *Message) mergeMetadata(fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	var from Metadata
+	if err = json.Unmarshal(b, &from); err != nil {
+		return err
+	}
+
+	if m.Metadata == nil {
+		m.Metadata = &Metadata{}
+	}
+	md := m.Metadata
+	if md.CorrelationStreamName == "" {
+		md.CorrelationStreamName = from.CorrelationStreamName
+	}
+	if md.CausationMessageStreamName == "" {
+		md.CausationMessageStreamName = from.CausationMessageStreamName
+		md.CausationMessagePosition = from.CausationMessagePosition
+		md.CausationMessageGlobalPosition = from.CausationMessageGlobalPosition
+	}
+	if md.ReplyStreamName == "" {
+		md.ReplyStreamName = from.ReplyStreamName
+	}
+	if md.SchemaVersion == 0 {
+		md.SchemaVersion = from.SchemaVersion
+	}
+	for key, value := range from.Extra {
+		if _, ok := md.Extra[key]; ok {
+			continue
+		}
+		if md.Extra == nil {
+			md.Extra = make(map[string]interface{})
+		}
+		md.Extra[key] = value
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package messagedb_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/brycedarling/messagedb"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	var tests = []struct {
+		name string
+		json string
+		want messagedb.Metadata
+	}{
+		{"empty", `{}`, messagedb.Metadata{}},
+		{"conventional",
+			`{"causationMessageGlobalPosition":12,"causationMessagePosition":0,"causationMessageStreamName":"account-1","correlationStreamName":"transfer-2","replyStreamName":"reply-3","schemaVersion":2}`,
+			messagedb.Metadata{
+				CorrelationStreamName:          "transfer-2",
+				CausationMessageStreamName:     "account-1",
+				CausationMessagePosition:       0,
+				CausationMessageGlobalPosition: 12,
+				ReplyStreamName:                "reply-3",
+				SchemaVersion:                  2,
+			}},
+		{"extra", `{"correlationStreamName":"transfer-2","tenant":"acme"}`,
+			messagedb.Metadata{
+				CorrelationStreamName: "transfer-2",
+				Extra:                 map[string]interface{}{"tenant": "acme"},
+			}},
+		{"mistyped conventional key kept as extra", `{"schemaVersion":"1"}`,
+			messagedb.Metadata{
+				Extra: map[string]interface{}{"schemaVersion": "1"},
+			}},
+		{"partial causation kept as extra", `{"causationMessageGlobalPosition":7,"causationMessagePosition":0}`,
+			messagedb.Metadata{
+				Extra: map[string]interface{}{"causationMessagePosition": 0.0, "causationMessageGlobalPosition": 7.0},
+			}},
+		{"zero values kept as extra", `{"correlationStreamName":"transfer-2","replyStreamName":"","schemaVersion":0}`,
+			messagedb.Metadata{
+				CorrelationStreamName: "transfer-2",
+				Extra:                 map[string]interface{}{"replyStreamName": "", "schemaVersion": 0.0},
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var md messagedb.Metadata
+			if err := json.Unmarshal([]byte(tt.json), &md); err != nil {
+				t.Fatalf("unexpected error '%s' when unmarshaling", err)
+			}
+			if !reflect.DeepEqual(md, tt.want) {
+				t.Errorf("got %+v, want %+v", md, tt.want)
+			}
+
+			b, err := json.Marshal(md)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when marshaling", err)
+			}
+			if string(b) != tt.json {
+				t.Errorf("got %s, want %s", b, tt.json)
+			}
+		})
+	}
+}
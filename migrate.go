@@ -0,0 +1,49 @@
+package messagedb
+
+// MigrateStream copies the messages of the entity stream src to the entity
+// stream dst, in order, and returns how many it wrote. Each message is passed
+// to transform, which may change it, for example renaming its type, or return
+// nil to leave it out; a nil transform copies every message unchanged. A
+// message's Data is written in place of its RawData when its data is a JSON
+// object, so transform can edit Data.
+//
+// The copies are given new IDs and keep their types, data and metadata. dst
+// must be empty, and each copy is written expecting the version the one
+// before it left, so with no messages left out every message keeps its
+// position, and a concurrent write to dst stops the migration with a version
+// conflict. Messages are written one at a time, so a failed migration leaves
+// the messages before the failure in dst. src is left unchanged.
+func (m *messageDB) MigrateStream(src, dst string, transform func(*Message) *Message) (int, error) {
+	if !isEntityStream(src) || !isEntityStream(dst) {
+		return 0, ErrEntityStreamRequired
+	}
+
+	count := 0
+	version := noStreamVersion
+	_, err := m.Replay(src, 0, func(msg *Message) error {
+		if msg.Data != nil {
+			msg.RawData = nil
+		}
+		if transform != nil {
+			if msg = transform(msg); msg == nil {
+				return nil
+			}
+		}
+
+		expectedVersion := version
+		migrated := NewMessage(dst, msg.Type)
+		migrated.Data = msg.Data
+		migrated.RawData = msg.RawData
+		migrated.Metadata = msg.Metadata
+		migrated.ExpectedVersion = &expectedVersion
+
+		position, err := m.Write(migrated)
+		if err != nil {
+			return err
+		}
+		version = position
+		count++
+		return nil
+	})
+	return count, err
+}
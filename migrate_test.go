@@ -0,0 +1,68 @@
+package messagedb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestMigrateStream(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	src := "account-1"
+	dst := "wallet-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(src, 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), src, "Opened", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), src, "Deposited", 1, 2, []byte(`{"amount":10}`), []byte(`{"schemaVersion":2}`), time.Now()).
+			AddRow(uuid.New(), src, "Audited", 2, 3, nil, nil, time.Now()))
+
+	next := func(position string) *sqlmock.Rows {
+		return mock.NewRows([]string{"next_position"}).FromCSVString(position)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), dst, "Opened", []uint8("null"), []uint8("null"), -1).
+		WillReturnRows(next("0"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), dst, "Credited", []uint8(`{"amount":10}`), []uint8(`{"schemaVersion":2}`), 0).
+		WillReturnRows(next("1"))
+	mock.ExpectCommit()
+
+	count, err := messagedb.New(db).MigrateStream(src, dst, func(msg *messagedb.Message) *messagedb.Message {
+		switch msg.Type {
+		case "Deposited":
+			msg.Type = "Credited"
+		case "Audited":
+			return nil
+		}
+		return msg
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when migrating", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d messages migrated, want 2", count)
+	}
+
+	if _, err := messagedb.New(db).MigrateStream(src, "wallet", nil); err != messagedb.ErrEntityStreamRequired {
+		t.Errorf("got %v, want %s", err, messagedb.ErrEntityStreamRequired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
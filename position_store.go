@@ -0,0 +1,179 @@
+package messagedb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PositionStore persists how far each subscriber has read, the global
+// position of the last message it handled, so that a subscription resumes
+// from there when restarted. Subscriptions save their position to the store
+// set with WithPositionStore, or to message-db itself by default.
+type PositionStore interface {
+	// Load returns the position last saved for subscriberID, or 0 if none
+	// has been.
+	Load(subscriberID string) (int, error)
+	// Save records position as how far subscriberID has read.
+	Save(subscriberID string, position int) error
+}
+
+// NewPositionStore returns the PositionStore subscriptions use by default,
+// which writes each position as a message of type PositionMessageType to the
+// subscriber's subscriberPosition-{id} stream in store.
+//
+// Each position is written expecting the stream to be at the version the
+// store last saw. If another instance of the subscriber has written to it
+// since, the position it recorded is read and the save is skipped unless it
+// would move the position forward, so the recorded position never moves
+// backward. Positions are read from the primary of a MessageDB made by
+// NewReadWrite, as a stale version would make every save conflict.
+func NewPositionStore(store MessageDB) PositionStore {
+	if m, ok := store.(*messageDB); ok {
+		store = m.primary()
+	}
+	return &streamPositionStore{
+		messageDB: store,
+		versions:  make(map[string]int),
+	}
+}
+
+type streamPositionStore struct {
+	messageDB MessageDB
+
+	mu sync.Mutex
+	// versions holds the version of each subscriber's position stream as it
+	// was last read or written.
+	versions map[string]int
+}
+
+func (p *streamPositionStore) Load(subscriberID string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.load(subscriberID)
+}
+
+func (p *streamPositionStore) load(subscriberID string) (int, error) {
+	msg, err := p.messageDB.ReadLast(PositionStreamName(subscriberID))
+	if err != nil {
+		return 0, err
+	}
+	if msg == nil {
+		p.versions[subscriberID] = noStreamVersion
+		return 0, nil
+	}
+	p.versions[subscriberID] = msg.Position
+	position, ok := recordedPosition(msg)
+	if !ok {
+		return 0, ErrCorruptPosition{Message: msg}
+	}
+	return position, nil
+}
+
+// recordedPosition returns the position recorded by a position message,
+// reporting false if msg is not one or records no position.
+func recordedPosition(msg *Message) (int, bool) {
+	if msg.Type != PositionMessageType {
+		return 0, false
+	}
+	position, ok := msg.Data[globalPositionKey].(float64)
+	return int(position), ok
+}
+
+// ErrCorruptPosition is returned when the last message of a subscriber's
+// position stream is not a position message of type PositionMessageType
+// recording a globalPosition, so the position the subscriber had reached
+// cannot be known. Rather than reprocess from the beginning, subscriptions
+// fail to start until the stream is repaired, such as by ResetSubscriber or
+// by writing the correct position.
+type ErrCorruptPosition struct {
+	Message *Message
+}
+
+func (err ErrCorruptPosition) Error() string {
+	return fmt.Sprintf("position stream %s ends with '%s' message %s at position %d, not a position",
+		err.Message.StreamName, err.Message.Type, err.Message.ID, err.Message.Position)
+}
+
+func (p *streamPositionStore) Save(subscriberID string, position int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		expectedVersion, ok := p.versions[subscriberID]
+		if !ok {
+			expectedVersion = noStreamVersion
+		}
+		version, err := writePosition(p.messageDB, PositionStreamName(subscriberID), position, &expectedVersion)
+		if err == nil {
+			p.versions[subscriberID] = version
+			return nil
+		}
+		if !isVersionConflict(err) {
+			return err
+		}
+
+		recorded, err := p.load(subscriberID)
+		if err != nil {
+			return err
+		}
+		if recorded >= position {
+			return nil
+		}
+	}
+}
+
+// writePosition writes position to a subscriber's position stream.
+func writePosition(messageDB MessageDB, subscriberStreamName string, position int, expectedVersion *int) (int, error) {
+	msg := NewMessage(subscriberStreamName, PositionMessageType)
+	msg.Data = map[string]interface{}{
+		globalPositionKey: position,
+	}
+	msg.ExpectedVersion = expectedVersion
+	return messageDB.Write(msg)
+}
+
+// SubscriberStatus is the last position a subscriber recorded.
+type SubscriberStatus struct {
+	SubscriberID string
+	StreamName   string
+	Position     int
+	// RecordedAt is when the position was written.
+	RecordedAt time.Time
+}
+
+// ListSubscribers returns the last position recorded by each subscriber that
+// keeps its position in message-db, in order of subscriber ID. Subscribers
+// using another PositionStore are not listed. The whole subscriberPosition
+// category is read, every position ever written, so it suits dashboards and
+// diagnostics rather than frequent polling.
+func (m *messageDB) ListSubscribers() ([]SubscriberStatus, error) {
+	last := make(map[string]*Message)
+	for msg, err := range m.Stream(subscriberPositionCategory, 0) {
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type == PositionMessageType {
+			last[msg.StreamName] = msg
+		}
+	}
+
+	statuses := make([]SubscriberStatus, 0, len(last))
+	for streamName, msg := range last {
+		subscriberID, ok := SubscriberIDFromPositionStream(streamName)
+		if !ok {
+			continue
+		}
+		position, _ := recordedPosition(msg)
+		statuses = append(statuses, SubscriberStatus{
+			SubscriberID: subscriberID,
+			StreamName:   streamName,
+			Position:     position,
+			RecordedAt:   msg.Time,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].SubscriberID < statuses[j].SubscriberID
+	})
+	return statuses, nil
+}
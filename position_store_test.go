@@ -0,0 +1,94 @@
+package messagedb_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestListSubscribers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	recordedAt := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("subscriberPosition", 0, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "subscriberPosition-shipping", "Read", 0, 3, `{"globalPosition":2}`, nil, recordedAt).
+			AddRow(uuid.New(), "subscriberPosition-billing", "Read", 0, 5, `{"globalPosition":4}`, nil, recordedAt).
+			AddRow(uuid.New(), "subscriberPosition-shipping", "Read", 1, 9, `{"globalPosition":8}`, nil, recordedAt))
+
+	statuses, err := messagedb.New(db).ListSubscribers()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when listing subscribers", err)
+	}
+
+	want := []messagedb.SubscriberStatus{
+		{SubscriberID: "billing", StreamName: "subscriberPosition-billing", Position: 4, RecordedAt: recordedAt},
+		{SubscriberID: "shipping", StreamName: "subscriberPosition-shipping", Position: 8, RecordedAt: recordedAt},
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("got %v, want %v", statuses, want)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("got %+v, want %+v", statuses[i], want[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestPositionStoreCorruptPosition(t *testing.T) {
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	var tests = []struct {
+		name    string
+		msgType string
+		data    string
+	}{
+		{"wrong type", "Deposited", `{"globalPosition":4}`},
+		{"no position", "Read", `{"position":4}`},
+		{"no data", "Read", "null"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs("subscriberPosition-shipping").
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "subscriberPosition-shipping", tt.msgType, 3, 7, []byte(tt.data), nil, time.Now()))
+
+			_, err = messagedb.NewPositionStore(messagedb.New(db)).Load("shipping")
+			var corrupt messagedb.ErrCorruptPosition
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("got %v, want an ErrCorruptPosition", err)
+			}
+			if corrupt.Message.Type != tt.msgType || corrupt.Message.Position != 3 {
+				t.Errorf("got message %+v, want the last message of the position stream", corrupt.Message)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package messagedb
+
+import (
+	"errors"
+	"time"
+)
+
+const replyPollInterval time.Duration = 100 * time.Millisecond
+
+// WriteAndAwaitReply writes cmd with replyStream as its reply stream name and
+// then polls replyStream, usually an entity stream unique to the caller, for a
+// message that follows cmd, one whose causation is cmd's stream and position.
+// Only messages written after cmd are read: from the end of an entity stream,
+// or past the store's newest global position for a category. It returns the
+// reply, or ErrReplyTimeout if none is written within timeout.
+func (m *messageDB) WriteAndAwaitReply(cmd *Message, replyStream string, timeout time.Duration) (*Message, error) {
+	if replyStream == "" {
+		return nil, ErrStreamNameRequired
+	}
+
+	position := 0
+	if isEntityStream(replyStream) {
+		last, err := m.ReadLast(replyStream)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			position = last.Position + 1
+		}
+	} else {
+		max, err := m.MaxGlobalPosition()
+		if err != nil {
+			return nil, err
+		}
+		position = max + 1
+	}
+
+	if cmd.Metadata == nil {
+		cmd.Metadata = &Metadata{}
+	}
+	cmd.Metadata.ReplyStreamName = replyStream
+	cmdPosition, err := m.Write(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// The waits are counted as well, so the timeout passes in real time
+	// even if the store's clock does not.
+	deadline := m.now().Add(timeout)
+	waits := int((timeout + replyPollInterval - 1) / replyPollInterval)
+	for {
+		more, err := m.Read(replyStream, position, m.blockSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range more {
+			if msg.CausationMessageStreamName() == cmd.StreamName && msg.CausationMessagePosition() == cmdPosition {
+				return msg, nil
+			}
+			position = nextPosition(replyStream, msg)
+		}
+		if len(more) == m.blockSize {
+			continue
+		}
+		if waits <= 0 || !m.now().Before(deadline) {
+			return nil, ErrReplyTimeout
+		}
+		waits--
+		time.Sleep(replyPollInterval)
+	}
+}
+
+// ErrReplyTimeout ...
+var ErrReplyTimeout = errors.New("timed out awaiting reply")
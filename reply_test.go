@@ -0,0 +1,208 @@
+package messagedb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestWriteAndAwaitReply(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	replyStream := "reply-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(replyStream).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), replyStream, "Replied", 1, 5, nil, nil, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), "account:command-1", "Withdraw", sqlmock.AnyArg(), []uint8(`{"replyStreamName":"reply-1"}`), nil).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("3"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(replyStream, 2, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), replyStream, "Replied", 2, 6, nil, []byte(`{"causationMessageStreamName":"account:command-1","causationMessagePosition":2}`), time.Now()))
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(replyStream, 3, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), replyStream, "Withdrawn", 3, 8, nil, []byte(`{"causationMessageStreamName":"account:command-1","causationMessagePosition":3}`), time.Now()))
+
+	m := messagedb.New(db)
+
+	reply, err := m.WriteAndAwaitReply(messagedb.NewMessage("account:command-1", "Withdraw"), replyStream, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when awaiting reply", err)
+	}
+	if reply.Type != "Withdrawn" {
+		t.Errorf("got reply %s, want Withdrawn", reply.Type)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteAndAwaitReplyTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	replyStream := "reply-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(replyStream).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(replyStream, 0, 1000).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	if _, err := m.WriteAndAwaitReply(messagedb.NewMessage("account:command-1", "Withdraw"), replyStream, 0); err != messagedb.ErrReplyTimeout {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrReplyTimeout)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteAndAwaitReplyWithClock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	replyStream := "reply-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(replyStream).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("get_stream_messages").
+		WithArgs(replyStream, 0, 1000).
+		WillReturnRows(mock.NewRows(columns))
+
+	// Each call to the clock moves it on an hour, so the deadline passes
+	// after the first poll without waiting for it.
+	now := time.Now()
+	clock := func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+	m := messagedb.New(db, messagedb.WithClock(clock))
+
+	start := time.Now()
+	if _, err := m.WriteAndAwaitReply(messagedb.NewMessage("account:command-1", "Withdraw"), replyStream, time.Hour); err != messagedb.ErrReplyTimeout {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrReplyTimeout)
+	}
+	if waited := time.Since(start); waited >= time.Minute {
+		t.Errorf("waited %s for the timeout, want it reached by the clock", waited)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteAndAwaitReplyWithStoppedClock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	replyStream := "reply-1"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(replyStream).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+	// The timeout passes during the wait after the first poll.
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("get_stream_messages").
+			WithArgs(replyStream, 0, 1000).
+			WillReturnRows(mock.NewRows(columns))
+	}
+
+	// A clock that stands still must not keep the call waiting forever.
+	stopped := time.Now()
+	m := messagedb.New(db, messagedb.WithClock(func() time.Time { return stopped }))
+
+	if _, err := m.WriteAndAwaitReply(messagedb.NewMessage("account:command-1", "Withdraw"), replyStream, 50*time.Millisecond); err != messagedb.ErrReplyTimeout {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrReplyTimeout)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestWriteAndAwaitReplyFromCategory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	replyStream := "reply"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	// The category's history is not read again: polling starts past the
+	// newest message in the store when the command is written.
+	mock.ExpectQuery("max\\(global_position\\)").
+		WillReturnRows(mock.NewRows([]string{"max"}).AddRow(41))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("3"))
+	mock.ExpectCommit()
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(replyStream, 42, 1000).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "reply-1", "Withdrawn", 0, 43, nil, []byte(`{"causationMessageStreamName":"account:command-1","causationMessagePosition":3}`), time.Now()))
+
+	m := messagedb.New(db)
+
+	reply, err := m.WriteAndAwaitReply(messagedb.NewMessage("account:command-1", "Withdraw"), replyStream, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when awaiting reply", err)
+	}
+	if reply.GlobalPosition != 43 {
+		t.Errorf("got reply at global position %d, want 43", reply.GlobalPosition)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
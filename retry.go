@@ -0,0 +1,82 @@
+package messagedb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy ...
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. Values
+	// less than 1 mean a single attempt.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for each retry
+	// after that.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. Zero means no cap.
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is chosen at
+	// random so that competing clients spread out their retries.
+	Jitter float64
+	// IsRetryable reports whether an error should be retried. When nil every
+	// error is retried except validation errors, expected version conflicts
+	// and the errors of a done context, which would fail again.
+	IsRetryable func(error) bool
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable, or
+// the policy runs out of attempts, returning the last error.
+func (p RetryPolicy) Do(fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= p.MaxAttempts || !p.retryable(err) {
+			return err
+		}
+		time.Sleep(p.delay(attempt))
+	}
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.IsRetryable != nil {
+		return p.IsRetryable(err)
+	}
+	var (
+		duplicate    ErrDuplicateMessageID
+		notInstalled ErrSchemaNotInstalled
+		searchPath   ErrSearchPathNotSet
+		tooLarge     ErrPayloadTooLarge
+	)
+	if errors.As(err, &duplicate) || errors.As(err, &notInstalled) || errors.As(err, &searchPath) ||
+		errors.As(err, &tooLarge) || isVersionConflict(err) {
+		return false
+	}
+	for _, permanent := range []error{
+		context.Canceled, context.DeadlineExceeded, ErrStreamNameRequired, ErrTypeRequired,
+		ErrInvalidRawData, ErrInvalidExpectedVersion, ErrConditionNotMet,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// delay returns how long to wait after the given failed attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
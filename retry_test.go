@@ -0,0 +1,55 @@
+package messagedb_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/brycedarling/messagedb"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	errTransient := errors.New("transient")
+
+	var tests = []struct {
+		name     string
+		policy   messagedb.RetryPolicy
+		failures int
+		err      error
+		attempts int
+		wantErr  bool
+	}{
+		{"succeeds first time", messagedb.RetryPolicy{MaxAttempts: 3}, 0, errTransient, 1, false},
+		{"succeeds after retries", messagedb.RetryPolicy{MaxAttempts: 3}, 2, errTransient, 3, false},
+		{"runs out of attempts", messagedb.RetryPolicy{MaxAttempts: 3}, 5, errTransient, 3, true},
+		{"zero attempts means one", messagedb.RetryPolicy{}, 5, errTransient, 1, true},
+		{"version conflict is not retried", messagedb.RetryPolicy{MaxAttempts: 3}, 5, messagedb.ErrVersionConflict{}, 1, true},
+		{"wrapped version conflict is not retried", messagedb.RetryPolicy{MaxAttempts: 3}, 5, fmt.Errorf("writing batch: %w", messagedb.ErrVersionConflict{}), 1, true},
+		{"wrapped duplicate is not retried", messagedb.RetryPolicy{MaxAttempts: 3}, 5, messagedb.ErrWrite{Err: messagedb.ErrDuplicateMessageID{}}, 1, true},
+		{"wrapped validation error is not retried", messagedb.RetryPolicy{MaxAttempts: 3}, 5, fmt.Errorf("writing batch: %w", messagedb.ErrTypeRequired), 1, true},
+		{"write error is retried", messagedb.RetryPolicy{MaxAttempts: 3}, 2, messagedb.ErrWrite{Err: errTransient}, 3, false},
+		{"custom retryable", messagedb.RetryPolicy{MaxAttempts: 3, IsRetryable: func(err error) bool {
+			return err != errTransient
+		}}, 5, errTransient, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := tt.policy.Do(func() error {
+				attempts++
+				if attempts <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
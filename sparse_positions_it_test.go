@@ -0,0 +1,82 @@
+//go:build integration
+// +build integration
+
+package messagedb
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sethvargo/go-diceware/diceware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// insertAtGlobalPosition writes a message straight into the messages table at
+// an explicit global position, bypassing write_message, so tests can build
+// categories whose global positions are not contiguous. It is only for tests:
+// nothing checks the stream position, and the global position sequence is
+// moved past the new message so later writes do not collide with it.
+func insertAtGlobalPosition(t *testing.T, db *sql.DB, streamName string, position, globalPosition int) {
+	t.Helper()
+
+	_, err := db.Exec(`INSERT INTO messages (id, stream_name, type, position, global_position, data, metadata, time)
+		VALUES ($1, $2, 'Sparse', $3, $4, '{}', NULL, now() AT TIME ZONE 'utc')`,
+		uuid.New().String(), streamName, position, globalPosition)
+	require.Nil(t, err, "error inserting message at global position %d: %v", globalPosition, err)
+
+	_, err = db.Exec(`SELECT setval(pg_get_serial_sequence('messages', 'global_position'), (SELECT max(global_position) FROM messages))`)
+	require.Nil(t, err, "error advancing global position sequence: %v", err)
+}
+
+// Reads a category whose global positions have gaps wider than a block, and
+// insures every message is read exactly once and in order.
+func Test_ReadAllSparseCategory(t *testing.T) {
+	db, err := Connect("pgx", GetOrDefault(EnvDbUrl, defaultStoreUrl), GetOrDefault(EnvMessageStoreDb, defaultStoreDb))
+	require.Nil(t, err, "error creating an sql.DB: %v", err)
+	defer db.Close()
+
+	messageStore := New(db, WithBlockSize(2))
+
+	base, err := messageStore.MaxGlobalPosition()
+	require.Nil(t, err, "error reading max global position: %v", err)
+
+	category := strings.Join(diceware.MustGenerate(2), "")
+	inserts := []struct {
+		id             string
+		position       int
+		globalPosition int
+	}{
+		{"a", 0, base + 3},
+		{"b", 0, base + 4},
+		{"a", 1, base + 10},
+		{"a", 2, base + 11},
+		{"b", 1, base + 50},
+		{"a", 3, base + 51},
+		{"b", 2, base + 52},
+	}
+	var want []int
+	for _, insert := range inserts {
+		insertAtGlobalPosition(t, db, category+"-"+insert.id, insert.position, insert.globalPosition)
+		want = append(want, insert.globalPosition)
+	}
+
+	msgs, err := messageStore.ReadAll(category)
+	require.Nil(t, err, "error reading category %s: %v", category, err)
+	var got []int
+	for _, msg := range msgs {
+		got = append(got, msg.GlobalPosition)
+	}
+	assert.Equal(t, want, got, "category read out of order or with gaps")
+
+	got = nil
+	lastPosition, err := messageStore.Replay(category, base+5, func(msg *Message) error {
+		got = append(got, msg.GlobalPosition)
+		return nil
+	})
+	require.Nil(t, err, "error replaying category %s: %v", category, err)
+	assert.Equal(t, want[2:], got, "category replayed out of order or with gaps")
+	assert.Equal(t, base+52, lastPosition)
+}
@@ -0,0 +1,100 @@
+package messagedb
+
+import (
+	"errors"
+	"strings"
+)
+
+// The separators of stream names. They mirror message-db's own category,
+// id, cardinal_id and is_category functions, which get_category_messages and
+// the consumer group and correlation filters use on the server, so they are
+// fixed rather than configurable: a client splitting names differently would
+// disagree with the store about which messages belong to a category. Stream
+// names are only taken apart here.
+const (
+	streamIDSeparator   string = "-"
+	compoundIDSeparator string = "+"
+	categoryTypeSuffix  string = ":"
+	commandCategoryType string = "command"
+)
+
+// isEntityStream reports whether streamName names an entity stream rather
+// than a category, which is a name without a stream ID.
+func isEntityStream(streamName string) bool {
+	return strings.Contains(streamName, streamIDSeparator)
+}
+
+// StreamName returns the name of the entity stream for id in category, such
+// as account-123.
+func StreamName(category, id string) (string, error) {
+	if category == "" {
+		return "", ErrCategoryRequired
+	}
+	if strings.Contains(category, streamIDSeparator) {
+		return "", ErrInvalidCategory
+	}
+	if id == "" {
+		return "", ErrStreamIDRequired
+	}
+	return category + streamIDSeparator + id, nil
+}
+
+// CommandStreamName returns the name of the command stream for id in
+// category, such as account:command-123.
+func CommandStreamName(category, id string) (string, error) {
+	if strings.Contains(category, categoryTypeSuffix) {
+		return "", ErrInvalidCategory
+	}
+	if category == "" {
+		return "", ErrCategoryRequired
+	}
+	return StreamName(category+categoryTypeSuffix+commandCategoryType, id)
+}
+
+// Category returns the category of streamName, the part before the first
+// dash, or streamName itself if it is already a category.
+func Category(streamName string) string {
+	return strings.SplitN(streamName, streamIDSeparator, 2)[0]
+}
+
+// StreamID returns the id of streamName, everything after the first dash, or
+// "" if streamName is a category.
+func StreamID(streamName string) string {
+	parts := strings.SplitN(streamName, streamIDSeparator, 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// CardinalID returns the cardinal id of streamName, the first of the ids in
+// a compound stream id such as the 123 in account-123+456, or the whole id if
+// it is not compound.
+func CardinalID(streamName string) string {
+	return strings.SplitN(StreamID(streamName), compoundIDSeparator, 2)[0]
+}
+
+// ValidateStreamName returns an error if streamName is not a well formed
+// stream name: it must have a category and, if it has a stream ID separator,
+// a stream ID after it.
+func ValidateStreamName(streamName string) error {
+	if streamName == "" {
+		return ErrStreamNameRequired
+	}
+	if Category(streamName) == "" {
+		return ErrCategoryRequired
+	}
+	if isEntityStream(streamName) && StreamID(streamName) == "" {
+		return ErrStreamIDRequired
+	}
+	return nil
+}
+
+// ErrCategoryRequired ...
+var ErrCategoryRequired = errors.New("missing category")
+
+// ErrInvalidCategory ...
+var ErrInvalidCategory = errors.New("invalid category")
+
+// ErrStreamIDRequired ...
+var ErrStreamIDRequired = errors.New("missing stream id")
@@ -0,0 +1,103 @@
+package messagedb_test
+
+import (
+	"testing"
+
+	"github.com/brycedarling/messagedb"
+)
+
+func TestStreamName(t *testing.T) {
+	var tests = []struct {
+		name       string
+		build      func(category, id string) (string, error)
+		category   string
+		id         string
+		streamName string
+		err        error
+		// parsedCategory is the category parsed back out of streamName
+		parsedCategory string
+	}{
+		{"entity", messagedb.StreamName, "account", "123", "account-123", nil, "account"},
+		{"compound id", messagedb.StreamName, "account", "123-456", "account-123-456", nil, "account"},
+		{"command", messagedb.CommandStreamName, "account", "123", "account:command-123", nil, "account:command"},
+		{"category required", messagedb.StreamName, "", "123", "", messagedb.ErrCategoryRequired, ""},
+		{"id required", messagedb.StreamName, "account", "", "", messagedb.ErrStreamIDRequired, ""},
+		{"dash in category", messagedb.StreamName, "account-123", "456", "", messagedb.ErrInvalidCategory, ""},
+		{"command category required", messagedb.CommandStreamName, "", "123", "", messagedb.ErrCategoryRequired, ""},
+		{"command category type", messagedb.CommandStreamName, "account:command", "123", "", messagedb.ErrInvalidCategory, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamName, err := tt.build(tt.category, tt.id)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if streamName != tt.streamName {
+				t.Errorf("got stream name %s, want %s", streamName, tt.streamName)
+			}
+			if err != nil {
+				return
+			}
+			if category := messagedb.Category(streamName); category != tt.parsedCategory {
+				t.Errorf("got category %s, want %s", category, tt.parsedCategory)
+			}
+			if id := messagedb.StreamID(streamName); id != tt.id {
+				t.Errorf("got stream id %s, want %s", id, tt.id)
+			}
+		})
+	}
+}
+
+func TestStreamIDOfCategory(t *testing.T) {
+	if id := messagedb.StreamID("account"); id != "" {
+		t.Errorf("got stream id %s, want none", id)
+	}
+	if category := messagedb.Category("account"); category != "account" {
+		t.Errorf("got category %s, want account", category)
+	}
+}
+
+func TestCardinalID(t *testing.T) {
+	var tests = []struct {
+		streamName string
+		cardinalID string
+	}{
+		{"account-123", "123"},
+		{"account-123+456", "123"},
+		{"account:command-123+456", "123"},
+		{"account", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.streamName, func(t *testing.T) {
+			if cardinalID := messagedb.CardinalID(tt.streamName); cardinalID != tt.cardinalID {
+				t.Errorf("got cardinal id %s, want %s", cardinalID, tt.cardinalID)
+			}
+		})
+	}
+}
+
+func TestPositionStreamName(t *testing.T) {
+	if streamName := messagedb.PositionStreamName("billing"); streamName != "subscriberPosition-billing" {
+		t.Errorf("got stream name %s, want subscriberPosition-billing", streamName)
+	}
+
+	var tests = []struct {
+		streamName   string
+		subscriberID string
+		ok           bool
+	}{
+		{"subscriberPosition-billing", "billing", true},
+		{"subscriberPosition-billing-2", "billing-2", true},
+		{"subscriberPosition", "", false},
+		{"account-billing", "", false},
+	}
+
+	for _, tt := range tests {
+		subscriberID, ok := messagedb.SubscriberIDFromPositionStream(tt.streamName)
+		if subscriberID != tt.subscriberID || ok != tt.ok {
+			t.Errorf("%s: got %q, %t, want %q, %t", tt.streamName, subscriberID, ok, tt.subscriberID, tt.ok)
+		}
+	}
+}
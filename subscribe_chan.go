@@ -0,0 +1,83 @@
+package messagedb
+
+import (
+	"errors"
+	"sync"
+)
+
+// SubscribeChan subscribes to streamName and delivers every message, of any
+// type, on the returned message channel instead of to Subscribers, for
+// callers that route messages with their own dispatcher. The channel is
+// unbuffered and a message counts as handled once it has been received, so the
+// read position only advances past messages the caller has taken. Errors are
+// sent on the error channel, which is closed after the message channel when
+// the subscription stops. Errors wait for the caller without holding up the
+// subscription, so a caller may range over the messages alone, but until
+// every error has been received a goroutine stays behind to deliver them, and
+// under ContinueOnError they pile up while they go unreceived. Call the
+// returned func to unsubscribe.
+func (m *messageDB) SubscribeChan(streamName, subscriberID string, opts ...SubscriptionOption) (<-chan *Message, <-chan error, func()) {
+	msgs := make(chan *Message)
+	errs := make(chan error, 1)
+
+	done := make(chan struct{})
+	var once sync.Once
+	opts = append(opts, func(s *subscription) {
+		s.everyType = func(msg *Message) error {
+			select {
+			case msgs <- msg:
+				return nil
+			case <-done:
+				return errUnsubscribed
+			}
+		}
+	})
+
+	sub, err := newSubscription(m, streamName, subscriberID, opts...)
+	if err != nil {
+		errs <- err
+		close(errs)
+		close(msgs)
+		return msgs, errs, func() {}
+	}
+
+	subErrs := sub.Subscribe(nil)
+	go func() {
+		defer close(errs)
+		// Keep receiving the subscription's errors while earlier ones wait
+		// for the caller, so that it never blocks sending them, and close
+		// msgs as soon as it stops.
+		var pending []error
+		for subErrs != nil || len(pending) > 0 {
+			var out chan<- error
+			var next error
+			if len(pending) > 0 {
+				out, next = errs, pending[0]
+			}
+			select {
+			case err, ok := <-subErrs:
+				if !ok {
+					subErrs = nil
+					close(msgs)
+					continue
+				}
+				pending = append(pending, err)
+			case out <- next:
+				pending = pending[1:]
+			}
+		}
+	}()
+
+	return msgs, errs, func() {
+		once.Do(func() {
+			close(done)
+			sub.Unsubscribe()
+		})
+	}
+}
+
+// errUnsubscribed stops a subscription that is waiting, for the caller of
+// SubscribeChan to receive a message or for its turn to read under
+// WithMaxConcurrentPolls, when it is unsubscribed. The poll loop treats it as
+// an Unsubscribe, flushing the position without reporting an error.
+var errUnsubscribed = errors.New("unsubscribed")
@@ -0,0 +1,120 @@
+package messagedb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestSubscribeChan(t *testing.T) {
+	var tests = []struct {
+		name string
+		opts []messagedb.SubscriptionOption
+	}{
+		{"stop on error", nil},
+		// Unsubscribing while a message waits to be received is not a
+		// handler error to continue after.
+		{"continue on error", []messagedb.SubscriptionOption{messagedb.WithErrorPolicy(messagedb.ContinueOnError)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "stream"
+			subscriberID := "test"
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "stream-1", "first", 0, 1, nil, nil, time.Now()).
+					AddRow(uuid.New(), "stream-1", "second", 1, 2, nil, nil, time.Now()).
+					AddRow(uuid.New(), "stream-1", "third", 2, 3, nil, nil, time.Now()))
+
+			m := messagedb.New(db)
+
+			positions := &memoryPositionStore{positions: map[string]int{}}
+
+			opts := append([]messagedb.SubscriptionOption{messagedb.WithPositionStore(positions)}, tt.opts...)
+			msgs, errs, unsubscribe := m.SubscribeChan(streamName, subscriberID, opts...)
+
+			var got []string
+			for msg := range msgs {
+				got = append(got, msg.Type)
+				if len(got) == 2 {
+					break
+				}
+			}
+			unsubscribe()
+			unsubscribe()
+
+			// The third message may or may not have been sent before unsubscribing.
+			for msg := range msgs {
+				got = append(got, msg.Type)
+			}
+			for err := range errs {
+				t.Errorf("unexpected error '%s' when subscribed", err)
+			}
+
+			if len(got) < 2 || got[0] != "first" || got[1] != "second" {
+				t.Errorf("got messages %v, want first and second", got)
+			}
+			if position := positions.positions[subscriberID]; position != len(got) {
+				t.Errorf("got position %d, want %d", position, len(got))
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSubscribeChanWithUndrainedErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Every read fails, and the subscription carries on after each failure
+	// while the caller only receives messages.
+	m := messagedb.New(db)
+	msgs, errs, unsubscribe := m.SubscribeChan("stream", "test",
+		messagedb.WithPositionStore(&memoryPositionStore{positions: map[string]int{}}),
+		messagedb.WithErrorPolicy(messagedb.ContinueOnError))
+
+	time.AfterFunc(500*time.Millisecond, unsubscribe)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range msgs {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message channel not closed with errors left unreceived")
+	}
+
+	n := 0
+	for range errs {
+		n++
+	}
+	if n < 2 {
+		t.Errorf("got %d errors, want every failed read", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package messagedb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// AnyType is the Subscribers key of the subscriber that handles messages whose
+// type has no subscriber of its own.
+const AnyType = "*"
+
+const schemaVersionSeparator string = "@"
+
+// VersionedType returns the Subscribers key of the subscriber for messages of
+// msgType at the given schema version, such as Deposited@2. It is preferred
+// over the subscriber for msgType, which handles the versions without one.
+func VersionedType(msgType string, version int) string {
+	return msgType + schemaVersionSeparator + strconv.Itoa(version)
+}
+
+// SubscribersBuilder builds Subscribers one registration at a time, catching
+// a type registered twice that a map literal would silently overwrite.
+type SubscribersBuilder struct {
+	subscribers Subscribers
+	err         error
+}
+
+// NewSubscribers ...
+func NewSubscribers() *SubscribersBuilder {
+	return &SubscribersBuilder{subscribers: Subscribers{}}
+}
+
+// On registers subscriber for messages of msgType.
+func (b *SubscribersBuilder) On(msgType string, subscriber Subscriber) *SubscribersBuilder {
+	if b.err != nil {
+		return b
+	}
+	if _, ok := b.subscribers[msgType]; ok {
+		b.err = ErrDuplicateSubscriber{msgType}
+		return b
+	}
+	b.subscribers[msgType] = subscriber
+	return b
+}
+
+// OnVersion registers subscriber for messages of msgType at the given schema
+// version.
+func (b *SubscribersBuilder) OnVersion(msgType string, version int, subscriber Subscriber) *SubscribersBuilder {
+	return b.On(VersionedType(msgType, version), subscriber)
+}
+
+// OnAny registers subscriber for messages whose type has no subscriber
+// registered with On.
+func (b *SubscribersBuilder) OnAny(subscriber Subscriber) *SubscribersBuilder {
+	return b.On(AnyType, subscriber)
+}
+
+// Build returns the registered Subscribers, or the ErrDuplicateSubscriber for
+// the first type registered more than once.
+func (b *SubscribersBuilder) Build() (Subscribers, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	subscribers := make(Subscribers, len(b.subscribers))
+	for msgType, subscriber := range b.subscribers {
+		subscribers[msgType] = subscriber
+	}
+	return subscribers, nil
+}
+
+// ErrDuplicateSubscriber ...
+type ErrDuplicateSubscriber struct {
+	Type string
+}
+
+func (err ErrDuplicateSubscriber) Error() string {
+	return fmt.Sprintf("more than one subscriber registered for message type '%s'", err.Type)
+}
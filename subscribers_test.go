@@ -0,0 +1,171 @@
+package messagedb_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestSubscribersBuilder(t *testing.T) {
+	handle := func(*messagedb.Message) error { return nil }
+
+	subscribers, err := messagedb.NewSubscribers().
+		On("Deposited", handle).
+		On("Withdrawn", handle).
+		OnAny(handle).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when building subscribers", err)
+	}
+	for _, msgType := range []string{"Deposited", "Withdrawn", messagedb.AnyType} {
+		if subscribers[msgType] == nil {
+			t.Errorf("no subscriber registered for %s", msgType)
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		builder *messagedb.SubscribersBuilder
+		want    string
+	}{
+		{"type", messagedb.NewSubscribers().On("Deposited", handle).On("Withdrawn", handle).On("Deposited", handle), "Deposited"},
+		{"any", messagedb.NewSubscribers().OnAny(handle).On("Deposited", handle).OnAny(handle), messagedb.AnyType},
+	}
+	for _, test := range tests {
+		_, err := test.builder.Build()
+		var dup messagedb.ErrDuplicateSubscriber
+		if !errors.As(err, &dup) || dup.Type != test.want {
+			t.Errorf("%s: got %v, want duplicate subscriber for %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSubscriptionAnyTypeSubscriber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Opened", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 2)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []string
+	subscribers, err := messagedb.NewSubscribers().
+		On("Deposited", func(msg *messagedb.Message) error {
+			got = append(got, "deposited:"+msg.Type)
+			return nil
+		}).
+		OnAny(func(msg *messagedb.Message) error {
+			got = append(got, "any:"+msg.Type)
+			return nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when building subscribers", err)
+	}
+	for err := range sub.Subscribe(subscribers) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []string{"any:Opened", "deposited:Deposited"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionVersionedSubscriber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, `{"schemaVersion":2}`, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 2, 3, nil, `{"schemaVersion":3}`, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 3)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []string
+	handle := func(name string) messagedb.Subscriber {
+		return func(msg *messagedb.Message) error {
+			got = append(got, fmt.Sprintf("%s:%d", name, msg.SchemaVersion()))
+			return nil
+		}
+	}
+	subscribers, err := messagedb.NewSubscribers().
+		On("Deposited", handle("any")).
+		OnVersion("Deposited", 2, handle("v2")).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when building subscribers", err)
+	}
+	for err := range sub.Subscribe(subscribers) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []string{"any:0", "v2:2", "any:3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
@@ -1,179 +1,1338 @@
 package messagedb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Subscriber ...
-type Subscriber func(*Message)
+// Subscriber handles a message. Returning an error stops the subscription
+// without advancing its position past the message, and the error is sent on
+// the error channel returned by Subscribe wrapped in a SubscriptionError.
+type Subscriber func(*Message) error
 
 // Subscribers ...
 type Subscribers map[string]Subscriber
 
 // Subscription ...
+//
+// Unsubscribe may be called from any goroutine, including from within a
+// Subscriber. Subscribe should be called at most once per Subscription.
 type Subscription interface {
 	Subscribe(Subscribers) chan error
 	Unsubscribe()
+	// IsActive reports whether the subscription is polling for messages. It
+	// is false before Subscribe, after Unsubscribe, and once an error has
+	// stopped the subscription.
+	IsActive() bool
+	// Lag returns how many global positions the subscription is behind the
+	// newest message in the store, from MaxGlobalPosition. Messages in other
+	// categories count too, so for a category subscription it is an upper
+	// bound on the messages it has yet to read.
+	Lag() (int, error)
+	// Stats returns the subscription's counters so far. It may be called from
+	// any goroutine.
+	Stats() SubscriptionStats
+	// Context returns a context that is done once the subscription stops or
+	// is unsubscribed, carrying the values of the one given to WithContext.
+	// Subscribers can pass it to their own database calls and requests so
+	// that those are cancelled on shutdown and join the caller's traces.
+	Context() context.Context
+	// Logger returns the logger the subscription logs with, which adds its
+	// stream name and subscriber ID to every record, for subscribers to log
+	// with too.
+	Logger() *slog.Logger
+	// Pause stops the subscription reading messages without stopping it, for
+	// maintenance such as a migration. The batch in progress is finished and
+	// the position flushed on the next tick, after which nothing is read
+	// until Resume. The subscription stays active, keeps any lock it holds,
+	// and can still be unsubscribed. Pause and Resume may be called from any
+	// goroutine.
+	Pause()
+	// Resume carries on reading from the position a paused subscription
+	// reached, without loading it again.
+	Resume()
 }
 
-func newSubscription(messageDB MessageDB, streamName, subscriberID string) (Subscription, error) {
+// SubscriptionStats ...
+type SubscriptionStats struct {
+	// Processed is how many messages subscribers have handled.
+	Processed int
+	// Position is the global position the subscription has reached.
+	Position int
+	// LastError is the most recent error met while polling, including ones
+	// WithReconnect recovered from.
+	LastError error
+	// Ticks is how many times the subscription has polled, and IdleTicks how
+	// many of those read no messages.
+	Ticks     int
+	IdleTicks int
+	// DuplicatesSkipped is how many messages were read again after the
+	// subscription had moved past them, and so were not handled twice.
+	DuplicatesSkipped int
+	// PollWait is how long, in total, the subscription has waited for its
+	// turn to read under WithMaxConcurrentPolls.
+	PollWait time.Duration
+}
+
+// SubscriptionOption ...
+type SubscriptionOption func(*subscription)
+
+// WithOnTick registers a callback invoked after every tick, including ticks
+// that read no messages, with the number of messages processed and the
+// global position reached.
+func WithOnTick(onTick func(processed, position int)) SubscriptionOption {
+	return func(s *subscription) {
+		s.onTick = onTick
+	}
+}
+
+// WithOnCaughtUp registers a callback invoked once, after the first tick that
+// reads fewer messages than a full batch, when the subscription has handled
+// every message written before it started and moves on to new ones.
+func WithOnCaughtUp(onCaughtUp func()) SubscriptionOption {
+	return func(s *subscription) {
+		s.onCaughtUp = onCaughtUp
+	}
+}
+
+// WithAdaptiveBatch lets the number of messages read per tick vary between
+// min and max, doubling after each tick that reads a full batch, to catch up
+// quickly on a backlog, and halving after each tick that does not, to keep
+// batches small once caught up. The first batch is the default of 100 messages
+// kept within min and max.
+func WithAdaptiveBatch(min, max int) SubscriptionOption {
+	return func(s *subscription) {
+		if min < 1 {
+			min = 1
+		}
+		if max < min {
+			max = min
+		}
+		s.minMessagesPerTick = min
+		s.maxMessagesPerTick = max
+		if s.messagesPerTick < min {
+			s.messagesPerTick = min
+		}
+		if s.messagesPerTick > max {
+			s.messagesPerTick = max
+		}
+	}
+}
+
+const defaultPositionFlushInterval time.Duration = 10 * time.Second
+
+// WithPositionFlushInterval makes the subscription write its position once d
+// has passed since it last did, 10 seconds by default, even when fewer
+// messages than the count that triggers a write have been handled since, so a
+// quiet stream never holds much to reprocess on restart. The position is
+// checked after every poll, and also written when the subscription is
+// unsubscribed with messages handled since the last write. A d of 0 or less
+// writes by count alone. Time is measured by the store's clock, set by
+// WithClock.
+func WithPositionFlushInterval(d time.Duration) SubscriptionOption {
+	return func(s *subscription) {
+		s.positionFlushInterval = d
+	}
+}
+
+// WithRetryPolicy retries reading batches and writing the read position
+// according to policy before reporting an error on the error channel.
+func WithRetryPolicy(policy RetryPolicy) SubscriptionOption {
+	return func(s *subscription) {
+		s.retryPolicy = policy
+	}
+}
+
+// defaultFinalFlushPolicy retries the position write a subscription makes as
+// it stops briefly, for a little under a second at most.
+var defaultFinalFlushPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond}
+
+// WithFinalFlushRetryPolicy retries writing the position as the subscription
+// stops, including when it stops on an error, according to policy, in place of its RetryPolicy, so that a transient
+// failure during shutdown does not lose the position and cause messages to be
+// reprocessed on restart. By default it is tried 4 times, 100ms apart and
+// doubling. The write is not bound to the subscription's Context or the one
+// given to WithContext, so cancelling those, or their deadline passing, does
+// not cut it short; a caller waiting on a shutdown deadline should allow for
+// the policy's delays.
+func WithFinalFlushRetryPolicy(policy RetryPolicy) SubscriptionOption {
+	return func(s *subscription) {
+		s.finalFlushPolicy = policy
+	}
+}
+
+// WithReconnect keeps the subscription running when reading a batch or
+// writing its position fails, such as while the database is unreachable.
+// Instead of stopping with the error, the subscription reloads its last
+// persisted position, retrying according to policy, and resumes polling from
+// there, so messages handled since the position was last written are handled
+// again. *sql.DB replaces broken connections itself, so nothing else needs
+// reconnecting. The error is only sent on the error channel, and the
+// subscription stopped, once policy gives up. Handler errors stop the
+// subscription unless WithErrorPolicy says to continue.
+func WithReconnect(policy RetryPolicy) SubscriptionOption {
+	return func(s *subscription) {
+		s.reconnectPolicy = &policy
+	}
+}
+
+// ErrorPolicy decides whether an error stops a subscription.
+type ErrorPolicy int
+
+// The policies WithErrorPolicy accepts.
+const (
+	// StopOnError stops the subscription at its first error. It is the
+	// default.
+	StopOnError ErrorPolicy = iota
+	// ContinueOnError sends handler, read and position write errors on the
+	// error channel and keeps polling. A message whose handler fails is
+	// skipped, the position advancing past it; a failed read or position
+	// write is tried again on the next tick. Errors locking or loading the
+	// position, and an ErrOutOfOrder, still stop the subscription.
+	ContinueOnError
+)
+
+// WithErrorPolicy sets whether errors stop the subscription. Under
+// ContinueOnError the error channel must be received from, as the
+// subscription waits for each error to be taken before it carries on.
+func WithErrorPolicy(policy ErrorPolicy) SubscriptionOption {
+	return func(s *subscription) {
+		s.errorPolicy = policy
+	}
+}
+
+// WithPositionStore saves the subscription's position to store, such as a
+// table or a cache, instead of to its subscriberPosition-{id} stream.
+func WithPositionStore(store PositionStore) SubscriptionOption {
+	return func(s *subscription) {
+		s.positionStore = store
+	}
+}
+
+// WithConcurrency dispatches the messages of each batch to a pool of n workers
+// instead of handling them one at a time. The read position still advances in
+// order, only past messages whose handlers, and those of every message before
+// them, have completed, so a failed handler is retried from that message on
+// restart. Handlers may run concurrently and out of order, so they must be safe
+// for concurrent use and must not depend on the order of messages within a
+// batch. Values of n less than 2 handle messages serially.
+func WithConcurrency(n int) SubscriptionOption {
+	return func(s *subscription) {
+		s.concurrency = n
+	}
+}
+
+// WithSubscriberMiddleware wraps every subscriber passed to Subscribe with
+// middleware, for behavior common to all message types such as logging,
+// timing or recovering from panics. Middleware registered first is outermost.
+// An error returned by middleware stops the subscription like one returned by
+// the subscriber.
+func WithSubscriberMiddleware(middleware func(next Subscriber) Subscriber) SubscriptionOption {
+	return func(s *subscription) {
+		s.middleware = append(s.middleware, middleware)
+	}
+}
+
+// WithContext makes ctx the parent of the subscription's Context, so that its
+// values reach subscribers and cancelling it stops the subscription as
+// Unsubscribe would.
+func WithContext(ctx context.Context) SubscriptionOption {
+	return func(s *subscription) {
+		s.ctx = ctx
+	}
+}
+
+// WithLogger makes the subscription log when it starts, stops, catches up,
+// reconnects and fails to logger, with its stream name and subscriber ID
+// added to every record. Without it the subscription does not log.
+func WithLogger(logger *slog.Logger) SubscriptionOption {
+	return func(s *subscription) {
+		s.logger = logger
+	}
+}
+
+// WithBatchHandler makes the subscription hand each tick's messages to
+// handler in one call, in place of Subscribers, for handlers such as
+// projections that apply a batch more cheaply than one message at a time.
+// handler receives every message of the batch except position messages and
+// those outside a WithTypeFilter, and the position only advances past the
+// batch once it returns nil. Handlers registered with Subscribe are ignored.
+// It cannot be combined with WithAckBeforeHandle, and CreateSubscription
+// returns ErrAckBeforeHandleConflict if both are given.
+func WithBatchHandler(handler func(Messages) error) SubscriptionOption {
+	return func(s *subscription) {
+		s.batchHandler = handler
+	}
+}
+
+// WithAckBeforeHandle makes the subscription persist its read position past
+// each message before handing it to the subscriber, for at-most-once
+// delivery: a message whose handler fails, or is interrupted by a crash, is
+// not delivered again, so its effects may be lost. A handler error still
+// stops the subscription, but no longer holds the position back. Messages are
+// handled one at a time, and every message costs a position write. It cannot
+// be combined with WithBatchHandler, whose batches only advance the position
+// once handled, and CreateSubscription returns ErrAckBeforeHandleConflict if
+// both are given.
+func WithAckBeforeHandle() SubscriptionOption {
+	return func(s *subscription) {
+		s.ackBeforeHandle = true
+	}
+}
+
+// WithTypeFilter declares the only message types the subscription is
+// interested in. Messages of other types are skipped, and the read position
+// advances past them, where without a filter it only advances past messages
+// that have a subscriber. message-db cannot filter by type, so every message
+// of the stream is still read and filtered by the subscription.
+func WithTypeFilter(types []string) SubscriptionOption {
+	return func(s *subscription) {
+		s.typeFilter = make(map[string]bool, len(types))
+		for _, messageType := range types {
+			s.typeFilter[messageType] = true
+		}
+	}
+}
+
+// WithOrderingChecks is a debugging aid that stops the subscription with an
+// ErrOutOfOrder if it reads a message for a subscriber at or before the
+// position of the last one it handed a subscriber, a stream position for
+// entity streams and a global position for categories, which would mean its
+// position is being mismanaged. Messages without a subscriber are not checked.
+// Reconnects reload the position and so start the checks afresh.
+func WithOrderingChecks() SubscriptionOption {
+	return func(s *subscription) {
+		s.orderingChecks = true
+	}
+}
+
+// WithCorrelation makes a category subscription read only the messages whose
+// correlation stream name is in the category correlation, such as the replies
+// to the commands a process manager wrote. Writers set a message's
+// correlation stream name with Message.Correlate. It combines with
+// WithConsumerGroup.
+func WithCorrelation(correlation string) SubscriptionOption {
+	return func(s *subscription) {
+		s.filter.Correlation = correlation
+	}
+}
+
+// WithConsumerGroup makes a category subscription read only the streams that
+// message-db assigns to member of a group of size consumers, so that size
+// subscriptions, each with its own subscriber ID and member from 0 to size-1,
+// share the category's streams between them. It combines with
+// WithCorrelation.
+func WithConsumerGroup(member, size int) SubscriptionOption {
+	return func(s *subscription) {
+		s.filter.ConsumerGroupMember = member
+		s.filter.ConsumerGroupSize = size
+	}
+}
+
+// WithCondition makes a category subscription read only the messages that
+// meet the SQL condition, which needs message-db's message_store.sql_condition
+// setting on. See ReadStream for what a condition can do and why it must not
+// come from untrusted input.
+func WithCondition(condition string) SubscriptionOption {
+	return func(s *subscription) {
+		s.filter.Condition = condition
+	}
+}
+
+// WithExclusiveLock makes Subscribe take the advisory lock on the category of
+// the subscription's stream, failing with ErrCategoryLocked if another
+// process holds it. The lock is released when the subscription stops.
+func WithExclusiveLock() SubscriptionOption {
+	return func(s *subscription) {
+		s.exclusive = true
+	}
+}
+
+// WithSingleInstance makes Subscribe take the advisory lock on the
+// subscriber ID, failing with ErrSubscriberAlreadyActive if another instance
+// of the subscriber holds it, so two processes never both advance its
+// position. The lock is released when the subscription stops.
+func WithSingleInstance() SubscriptionOption {
+	return func(s *subscription) {
+		s.singleInstance = true
+	}
+}
+
+func newSubscription(messageDB MessageDB, streamName, subscriberID string, opts ...SubscriptionOption) (Subscription, error) {
 	if streamName == "" {
 		return nil, ErrStreamNameRequired
 	}
 	if subscriberID == "" {
 		return nil, ErrSubscriberIDRequired
 	}
-	return &subscription{
+	s := &subscription{
 		messageDB:                      messageDB,
 		streamName:                     streamName,
 		subscriberID:                   subscriberID,
-		subscriberStreamName:           fmt.Sprintf("subscriberPosition-%s", subscriberID),
-		currentPosition:                0,
+		subscriberStreamName:           PositionStreamName(subscriberID),
 		globalPosition:                 0,
 		messagesSinceLastPositionWrite: 0,
-		isPolling:                      false,
 		positionUpdateInterval:         99,
+		positionFlushInterval:          defaultPositionFlushInterval,
 		messagesPerTick:                100,
 		tickIntervalMS:                 100 * time.Millisecond,
-	}, nil
+		ctx:                            context.Background(),
+		finalFlushPolicy:               defaultFinalFlushPolicy,
+		now:                            time.Now,
+	}
+	if c, ok := messageDB.(clock); ok {
+		s.now = c.currentTime
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ackBeforeHandle && s.batchHandler != nil {
+		return nil, ErrAckBeforeHandleConflict
+	}
+	s.ctx, s.cancel = context.WithCancel(s.ctx)
+	if s.logger == nil {
+		s.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	s.logger = s.logger.With("streamName", streamName, "subscriberID", subscriberID)
+	if s.positionStore == nil {
+		s.positionStore = NewPositionStore(messageDB)
+	}
+	if s.dedupTable != "" {
+		if _, ok := messageDB.(txBeginner); !ok {
+			return nil, ErrDedupUnsupported
+		}
+	}
+	if s.filter != (CategoryFilter{}) {
+		if isEntityStream(streamName) {
+			return nil, ErrInvalidCategory
+		}
+		if err := s.filter.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// PositionMessageType is the type of the messages a subscription writes to
+// its subscriberPosition-{id} stream to record how far it has read. The type
+// is reserved in that category: subscriptions never deliver those messages to
+// their subscribers, even when subscribed to a stream that contains them.
+const PositionMessageType = "Read"
+
+const subscriberPositionCategory = "subscriberPosition"
+
+// PositionStreamName returns the name of the stream a subscription records
+// its position in, subscriberPosition-{subscriberID}.
+func PositionStreamName(subscriberID string) string {
+	return subscriberPositionCategory + streamIDSeparator + subscriberID
+}
+
+// SubscriberIDFromPositionStream returns the ID of the subscriber whose
+// position streamName records, reporting false if it is not a position
+// stream.
+func SubscriberIDFromPositionStream(streamName string) (string, bool) {
+	if Category(streamName) != subscriberPositionCategory {
+		return "", false
+	}
+	id := StreamID(streamName)
+	return id, id != ""
 }
 
 // ErrSubscriberIDRequired ...
 var ErrSubscriberIDRequired = errors.New("missing subscriber id")
 
+// ErrAckBeforeHandleConflict ...
+var ErrAckBeforeHandleConflict = errors.New("ack before handle cannot be combined with a batch handler")
+
 type subscription struct {
 	messageDB                      MessageDB
 	streamName                     string
 	subscriberID                   string
 	subscriberStreamName           string
-	currentPosition                int
 	globalPosition                 int
+	reachedGlobalPosition          int64
 	messagesSinceLastPositionWrite int
-	isPolling                      bool
+	isPolling                      int32
+	isPaused                       int32
 	positionUpdateInterval         int
+	positionFlushInterval          time.Duration
+	lastPositionWrite              time.Time
+	now                            func() time.Time
 	messagesPerTick                int
+	minMessagesPerTick             int
+	maxMessagesPerTick             int
 	tickIntervalMS                 time.Duration
 	subscribers                    Subscribers
+	middleware                     []func(Subscriber) Subscriber
+	onTick                         func(processed, position int)
+	onCaughtUp                     func()
+	caughtUp                       bool
+	retryPolicy                    RetryPolicy
+	finalFlushPolicy               RetryPolicy
+	positionStore                  PositionStore
+	reconnectPolicy                *RetryPolicy
+	concurrency                    int
+	exclusive                      bool
+	singleInstance                 bool
+	ackBeforeHandle                bool
+	filter                         CategoryFilter
+	typeFilter                     map[string]bool
+	orderingChecks                 bool
+	errorPolicy                    ErrorPolicy
+	errs                           chan error
+	ctx                            context.Context
+	cancel                         context.CancelFunc
+	logger                         *slog.Logger
+	statsMu                        sync.Mutex
+	stats                          SubscriptionStats
+	lastDeliveredPosition          int
+	// batch is the buffer each batch is read into.
+	batch Messages
+	// everyType, when set, handles messages of every type in place of
+	// subscribers.
+	everyType     Subscriber
+	batchHandler  func(Messages) error
+	dedupTable    string
+	txSubscribers TxSubscribers
+	// holding is whether the poll loop has seen the subscription paused.
+	holding bool
 }
 
 var _ Subscription = (*subscription)(nil)
 
 func (s *subscription) Subscribe(subscribers Subscribers) chan error {
-	s.subscribers = subscribers
-	errs := make(chan error)
-	if err := s.loadPosition(); err != nil {
+	if s.dedupTable != "" {
+		subscribers = s.dedupSubscribers()
+	}
+	s.subscribers = s.wrap(subscribers)
+	if s.everyType != nil {
+		s.everyType = s.wrapSubscriber(s.everyType)
+	}
+	errs := make(chan error, 1)
+	unlock, err := s.lock()
+	if err == nil {
+		if err = s.loadPosition(); err != nil {
+			unlock()
+			err = s.failed(PhaseLoadPosition, err)
+		}
+	}
+	if err != nil {
+		s.logger.Error("subscription failed to start", "error", err)
+		s.cancel()
 		errs <- err
 		close(errs)
 		return errs
 	}
-	s.poll(errs)
+	s.logger.Info("subscription started", "globalPosition", s.globalPosition)
+	s.poll(errs, unlock)
 	return errs
 }
 
+// wrap returns a copy of subscribers with each subscriber wrapped in the
+// subscription's middleware.
+func (s *subscription) wrap(subscribers Subscribers) Subscribers {
+	if len(s.middleware) == 0 {
+		return subscribers
+	}
+	wrapped := make(Subscribers, len(subscribers))
+	for messageType, subscriber := range subscribers {
+		wrapped[messageType] = s.wrapSubscriber(subscriber)
+	}
+	return wrapped
+}
+
+func (s *subscription) wrapSubscriber(subscriber Subscriber) Subscriber {
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		subscriber = s.middleware[i](subscriber)
+	}
+	return subscriber
+}
+
+// lock takes the subscriber and category locks the subscription asks for,
+// returning the func that releases them.
+func (s *subscription) lock() (unlock func(), err error) {
+	var unlocks []func()
+	unlock = func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+	if s.singleInstance {
+		subscriberUnlock, ok, err := s.messageDB.TryLockSubscriber(s.subscriberID)
+		if err != nil {
+			return nil, s.failed(PhaseLock, err)
+		}
+		if !ok {
+			return nil, s.failed(PhaseLock, ErrSubscriberAlreadyActive)
+		}
+		unlocks = append(unlocks, subscriberUnlock)
+	}
+	if s.exclusive {
+		categoryUnlock, ok, err := s.messageDB.TryLockCategory(Category(s.streamName))
+		if err != nil {
+			unlock()
+			return nil, s.failed(PhaseLock, err)
+		}
+		if !ok {
+			unlock()
+			return nil, s.failed(PhaseLock, ErrCategoryLocked)
+		}
+		unlocks = append(unlocks, categoryUnlock)
+	}
+	return unlock, nil
+}
+
 func (s *subscription) Unsubscribe() {
-	s.isPolling = false
+	s.setPolling(false)
+	s.cancel()
 }
 
-const (
-	readPositionKey   string = "position"
-	globalPositionKey string = "globalPosition"
-)
+func (s *subscription) Context() context.Context {
+	return s.ctx
+}
+
+func (s *subscription) Logger() *slog.Logger {
+	return s.logger
+}
+
+func (s *subscription) Pause() {
+	atomic.StoreInt32(&s.isPaused, 1)
+}
+
+func (s *subscription) Resume() {
+	atomic.StoreInt32(&s.isPaused, 0)
+}
+
+func (s *subscription) paused() bool {
+	return atomic.LoadInt32(&s.isPaused) == 1
+}
+
+func (s *subscription) IsActive() bool {
+	return s.polling()
+}
+
+func (s *subscription) Lag() (int, error) {
+	max, err := s.messageDB.MaxGlobalPosition()
+	if err != nil {
+		return 0, err
+	}
+	if lag := max - int(atomic.LoadInt64(&s.reachedGlobalPosition)); lag > 0 {
+		return lag, nil
+	}
+	return 0, nil
+}
+
+func (s *subscription) Stats() SubscriptionStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats := s.stats
+	stats.Position = int(atomic.LoadInt64(&s.reachedGlobalPosition))
+	return stats
+}
+
+// updateStats applies fn to the subscription's stats.
+func (s *subscription) updateStats(fn func(*SubscriptionStats)) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	fn(&s.stats)
+}
+
+func (s *subscription) recordError(err error) {
+	s.updateStats(func(stats *SubscriptionStats) {
+		stats.LastError = err
+	})
+}
+
+// setGlobalPosition sets the global position reached, keeping a copy that
+// Lag can read from other goroutines.
+func (s *subscription) setGlobalPosition(globalPosition int) {
+	s.globalPosition = globalPosition
+	atomic.StoreInt64(&s.reachedGlobalPosition, int64(globalPosition))
+}
+
+func (s *subscription) setPolling(polling bool) {
+	var value int32
+	if polling {
+		value = 1
+	}
+	atomic.StoreInt32(&s.isPolling, value)
+}
+
+func (s *subscription) polling() bool {
+	return atomic.LoadInt32(&s.isPolling) == 1
+}
+
+const globalPositionKey string = "globalPosition"
 
 func (s *subscription) loadPosition() error {
-	msg, err := s.messageDB.ReadLast(s.subscriberStreamName)
+	globalPosition, err := s.positionStore.Load(s.subscriberID)
 	if err != nil {
 		return err
 	}
-	if msg != nil {
-		if position, ok := msg.Data[readPositionKey].(float64); ok {
-			s.currentPosition = int(position)
-		}
-	}
+	s.setGlobalPosition(globalPosition)
+	s.lastPositionWrite = s.now()
+	s.lastDeliveredPosition = -1
 	return nil
 }
 
-func (s *subscription) poll(errs chan error) {
-	s.isPolling = true
+// positionFlushDue reports whether positionFlushInterval has passed since the
+// position was last loaded or written.
+func (s *subscription) positionFlushDue() bool {
+	return s.positionFlushInterval > 0 && s.now().Sub(s.lastPositionWrite) >= s.positionFlushInterval
+}
+
+// flushPosition writes the position if messages have been handled since it
+// was last written.
+func (s *subscription) flushPosition() error {
+	if s.messagesSinceLastPositionWrite == 0 {
+		return nil
+	}
+	return s.failed(PhaseWritePosition, s.writeReadPosition(s.retryPolicy, s.globalPosition))
+}
+
+// flushFinalPosition writes the position as the subscription stops, whether
+// unsubscribed or failed, if messages have been handled since it was last
+// written, retrying under the final flush policy.
+func (s *subscription) flushFinalPosition() error {
+	if s.messagesSinceLastPositionWrite == 0 {
+		return nil
+	}
+	return s.failed(PhaseWritePosition, s.writeReadPosition(s.finalFlushPolicy, s.globalPosition))
+}
+
+func (s *subscription) poll(errs chan error, unlock func()) {
+	s.setPolling(true)
+	s.errs = errs
 
 	ticker := time.NewTicker(s.tickIntervalMS)
-	quit := make(chan struct{})
 
 	go func() {
+		defer close(errs)
+		defer unlock()
+		defer ticker.Stop()
+		defer s.cancel()
+
 		for count := 0; ; count++ {
 			select {
 			case <-ticker.C:
-				if err := s.tick(count); err != nil {
-					errs <- err
-					s.isPolling = false
+			case <-s.ctx.Done():
+				s.setPolling(false)
+			}
+			if s.polling() {
+				var err error
+				if s.paused() {
+					err = s.hold()
+				} else {
+					s.release()
+					err = s.tick(count)
+				}
+				if err != nil && !s.unsubscribedBy(err) {
+					s.recordError(err)
 				}
-				if !s.isPolling {
-					close(errs)
-					close(quit)
+				if s.unsubscribedBy(err) {
+					// The subscription was unsubscribed while waiting, for a
+					// SubscribeChan caller to receive a message, for its turn
+					// to read or for a query, so stop as Unsubscribe would.
+					s.setPolling(false)
+				} else if err != nil {
+					if err = s.reconnect(err); err != nil && !s.continueAfter(err) {
+						s.setPolling(false)
+						s.logger.Error("subscription failed", "error", err)
+						errs <- err
+						// The position only moves past messages handled, so it is
+						// flushed below as on a clean stop, unless the failure
+						// means the position itself cannot be trusted.
+						var orderErr ErrOutOfOrder
+						if errors.As(err, &orderErr) {
+							return
+						}
+					}
 				}
-			case <-quit:
-				ticker.Stop()
+			}
+			if !s.polling() {
+				if err := s.flushFinalPosition(); err != nil {
+					s.recordError(err)
+					s.logger.Error("subscription failed to flush its position", "error", err)
+					errs <- err
+				}
+				s.logger.Info("subscription stopped", "globalPosition", s.globalPosition)
+				return
 			}
 		}
 	}()
 }
 
+// unsubscribedBy reports whether err came of the subscription being
+// unsubscribed, or its Context being done, while it waited. Other errors are
+// reported even once the Context is done.
+func (s *subscription) unsubscribedBy(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errUnsubscribed) {
+		return true
+	}
+	ctxErr := s.ctx.Err()
+	return ctxErr != nil && (errors.Is(err, context.Canceled) || errors.Is(err, ctxErr))
+}
+
+// continueAfter reports whether the error policy lets the subscription carry
+// on after err, sending err on the error channel if so.
+func (s *subscription) continueAfter(err error) bool {
+	if s.unsubscribedBy(err) {
+		return false
+	}
+	var subErr SubscriptionError
+	var orderErr ErrOutOfOrder
+	if s.errorPolicy != ContinueOnError || !errors.As(err, &subErr) || errors.As(err, &orderErr) ||
+		(subErr.Phase != PhaseHandle && subErr.Phase != PhaseReadBatch && subErr.Phase != PhaseWritePosition) {
+		return false
+	}
+	s.recordError(err)
+	s.logger.Warn("subscription continuing after error", "error", err)
+	s.errs <- err
+	return true
+}
+
+// reconnect resumes the subscription from its persisted position after err,
+// returning the error to stop it with if it cannot.
+func (s *subscription) reconnect(err error) error {
+	var subErr SubscriptionError
+	var orderErr ErrOutOfOrder
+	if s.reconnectPolicy == nil || !errors.As(err, &subErr) || errors.As(err, &orderErr) ||
+		(subErr.Phase != PhaseReadBatch && subErr.Phase != PhaseWritePosition) {
+		return err
+	}
+	s.logger.Warn("subscription reconnecting", "error", err)
+	if err := s.reconnectPolicy.Do(s.loadPosition); err != nil {
+		return s.failed(PhaseLoadPosition, err)
+	}
+	s.messagesSinceLastPositionWrite = 0
+	return nil
+}
+
+// hold keeps a paused subscription from reading, flushing its position when
+// the poll loop first sees it paused.
+func (s *subscription) hold() error {
+	if s.holding {
+		return nil
+	}
+	s.holding = true
+	s.logger.Info("subscription paused", "globalPosition", s.globalPosition)
+	return s.flushPosition()
+}
+
+// release lets a subscription that was held read again.
+func (s *subscription) release() {
+	if s.holding {
+		s.holding = false
+		s.logger.Info("subscription resumed", "globalPosition", s.globalPosition)
+	}
+}
+
 func (s *subscription) tick(count int) error {
-	msgs, err := s.nextBatchOfMessages()
+	processed, err := s.readAndProcessBatch()
+	s.updateStats(func(stats *SubscriptionStats) {
+		stats.Ticks++
+		if processed == 0 && err == nil {
+			stats.IdleTicks++
+		}
+	})
 	if err != nil {
 		return err
 	}
-	if err = s.processBatch(msgs); err != nil {
-		return err
+	if s.positionFlushDue() {
+		if err := s.flushPosition(); err != nil {
+			return err
+		}
+	}
+	if !s.caughtUp && processed < s.messagesPerTick {
+		s.caughtUp = true
+		s.logger.Debug("subscription caught up", "globalPosition", s.globalPosition)
+		if s.onCaughtUp != nil {
+			s.onCaughtUp()
+		}
+	}
+	s.adaptBatch(processed)
+	if s.onTick != nil {
+		s.onTick(processed, s.globalPosition)
 	}
 	return nil
 }
 
-func (s *subscription) nextBatchOfMessages() (Messages, error) {
-	return s.messageDB.Read(s.streamName, s.globalPosition+1, s.messagesPerTick)
+// adaptBatch grows the batch after a full one and shrinks it after a partial
+// one when the subscription has an adaptive batch size.
+func (s *subscription) adaptBatch(processed int) {
+	if s.maxMessagesPerTick == 0 {
+		return
+	}
+	if processed >= s.messagesPerTick {
+		s.messagesPerTick *= 2
+		if s.messagesPerTick > s.maxMessagesPerTick {
+			s.messagesPerTick = s.maxMessagesPerTick
+		}
+	} else {
+		s.messagesPerTick /= 2
+		if s.messagesPerTick < s.minMessagesPerTick {
+			s.messagesPerTick = s.minMessagesPerTick
+		}
+	}
+}
+
+// clock is implemented by MessageDBs whose subscriptions take the current
+// time from them, as set by WithClock.
+type clock interface {
+	currentTime() time.Time
+}
+
+func (m *messageDB) currentTime() time.Time {
+	return m.now()
+}
+
+// pollLimiter is implemented by MessageDBs that bound how many of their
+// subscriptions read at once.
+type pollLimiter interface {
+	// acquirePoll waits for a turn to read, returning the func that ends it
+	// and how long the wait was, or errUnsubscribed if ctx is done first.
+	acquirePoll(ctx context.Context) (release func(), waited time.Duration, err error)
+}
+
+func (m *messageDB) acquirePoll(ctx context.Context) (func(), time.Duration, error) {
+	if m.pollSlots == nil {
+		return func() {}, 0, nil
+	}
+	release := func() { <-m.pollSlots }
+	select {
+	case m.pollSlots <- struct{}{}:
+		return release, 0, nil
+	default:
+	}
+	start := time.Now()
+	select {
+	case m.pollSlots <- struct{}{}:
+		return release, time.Since(start), nil
+	case <-ctx.Done():
+		return nil, time.Since(start), errUnsubscribed
+	}
+}
+
+// waitToPoll waits for the subscription's turn to read, returning the func
+// that ends it.
+func (s *subscription) waitToPoll() (func(), error) {
+	limiter, ok := s.messageDB.(pollLimiter)
+	if !ok {
+		return func() {}, nil
+	}
+	release, waited, err := limiter.acquirePoll(s.ctx)
+	if waited > 0 {
+		s.updateStats(func(stats *SubscriptionStats) {
+			stats.PollWait += waited
+		})
+	}
+	return release, err
+}
+
+// eachReader is implemented by MessageDBs that can hand over messages as they
+// are scanned, reading with a context that Unsubscribe cancels.
+type eachReader interface {
+	readEach(ctx context.Context, streamName string, position int, blockSize int, fn func(*Message) error) error
+}
+
+// readAndProcessBatch reads the next batch and handles its messages,
+// returning how many were read.
+func (s *subscription) readAndProcessBatch() (int, error) {
+	msgs, err := s.nextBatchOfMessages()
+	if err != nil {
+		return 0, err
+	}
+	return len(msgs), s.processBatch(msgs)
+}
+
+func (s *subscription) nextBatchOfMessages() (msgs Messages, err error) {
+	release, err := s.waitToPoll()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	err = s.retryPolicy.Do(func() (err error) {
+		if s.filter != (CategoryFilter{}) {
+			msgs, err = s.messageDB.ReadCategory(s.streamName, s.globalPosition+1, s.messagesPerTick, s.filter)
+			return err
+		}
+		if reader, ok := s.messageDB.(eachReader); ok {
+			// Each batch is read into the buffer of the one before it, so a
+			// busy subscription does not allocate a slice every tick. The
+			// read finishes before any message is handled, so its connection
+			// is free again for the position writes.
+			clear(s.batch)
+			s.batch = s.batch[:0]
+			err = reader.readEach(s.ctx, s.streamName, s.globalPosition+1, s.messagesPerTick, func(msg *Message) error {
+				s.batch = append(s.batch, msg)
+				return nil
+			})
+			msgs = s.batch
+			return err
+		}
+		msgs, err = s.messageDB.Read(s.streamName, s.globalPosition+1, s.messagesPerTick)
+		return err
+	})
+	return msgs, s.failed(PhaseReadBatch, err)
 }
 
 func (s *subscription) processBatch(msgs Messages) error {
+	if s.batchHandler != nil {
+		return s.processWholeBatch(msgs)
+	}
+	if s.concurrency > 1 && !s.ackBeforeHandle {
+		return s.processBatchConcurrently(msgs)
+	}
+	for _, msg := range msgs {
+		if err := s.processMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriberFor returns the subscriber for msg's type and schema version,
+// falling back to the one for its type and then to the AnyType subscriber,
+// and skipping the position messages written by this and other
+// subscriptions.
+func (s *subscription) subscriberFor(msg *Message) (Subscriber, bool) {
+	if !s.wants(msg) {
+		return nil, false
+	}
+	if s.everyType != nil {
+		return s.everyType, true
+	}
+	if version := msg.SchemaVersion(); version != 0 {
+		if subscriber, ok := s.subscribers[VersionedType(msg.Type, version)]; ok {
+			return subscriber, true
+		}
+	}
+	if subscriber, ok := s.subscribers[msg.Type]; ok {
+		return subscriber, true
+	}
+	subscriber, ok := s.subscribers[AnyType]
+	return subscriber, ok
+}
+
+// wants reports whether msg is one the subscription hands to its handlers,
+// being neither a position message nor filtered out by type.
+func (s *subscription) wants(msg *Message) bool {
+	if msg.StreamName == s.subscriberStreamName ||
+		(msg.Type == PositionMessageType && Category(msg.StreamName) == subscriberPositionCategory) {
+		return false
+	}
+	return s.typeFilter == nil || s.typeFilter[msg.Type]
+}
+
+// processWholeBatch hands the messages of msgs the subscription wants to its
+// batch handler, advancing the position past msgs if it succeeds.
+func (s *subscription) processWholeBatch(msgs Messages) error {
+	for _, msg := range msgs {
+		if !s.wants(msg) {
+			continue
+		}
+		if err := s.checkOrder(msg); err != nil {
+			return err
+		}
+	}
+	msgs = s.dropDuplicates(msgs)
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	var wanted Messages
+	for _, msg := range msgs {
+		if s.wants(msg) {
+			wanted = append(wanted, msg)
+		}
+	}
+	if len(wanted) > 0 {
+		if err := s.batchHandler(wanted); err != nil {
+			if err = s.failed(PhaseHandle, err); !s.continueAfter(err) {
+				return err
+			}
+		} else {
+			s.updateStats(func(stats *SubscriptionStats) {
+				stats.Processed += len(wanted)
+			})
+		}
+	}
+	return s.failed(PhaseWritePosition, s.advanceReadPosition(len(msgs), msgs[len(msgs)-1].GlobalPosition))
+}
+
+func (s *subscription) processMessage(msg *Message) error {
+	subscriber, ok := s.subscriberFor(msg)
+	if ok {
+		if err := s.checkOrder(msg); err != nil {
+			return err
+		}
+	}
+	if msg.GlobalPosition <= s.globalPosition {
+		s.updateStats(func(stats *SubscriptionStats) {
+			stats.DuplicatesSkipped++
+		})
+		return nil
+	}
+	if !ok {
+		return s.skip(msg)
+	}
+	if s.ackBeforeHandle {
+		return s.ackAndHandle(subscriber, msg)
+	}
+	if err := subscriber(msg); err != nil {
+		if s.unsubscribedBy(err) {
+			return err
+		}
+		if err = s.failed(PhaseHandle, err); !s.continueAfter(err) {
+			return err
+		}
+	} else {
+		s.countProcessed()
+	}
+	return s.failed(PhaseWritePosition, s.updateReadPosition(msg.GlobalPosition))
+}
+
+func (s *subscription) processBatchConcurrently(msgs Messages) error {
 	for _, msg := range msgs {
-		if subscriber, ok := s.subscribers[msg.Type]; ok {
-			subscriber(msg)
+		if _, ok := s.subscriberFor(msg); !ok {
+			continue
+		}
+		if err := s.checkOrder(msg); err != nil {
+			return err
+		}
+	}
+	msgs = s.dropDuplicates(msgs)
+
+	results := make([]chan error, len(msgs))
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
 
-			if err := s.updateReadPosition(msg.Position, msg.GlobalPosition); err != nil {
+	// Stop dispatching once this returns, and wait for handlers already
+	// running so none outlive the batch.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		workers := make(chan struct{}, s.concurrency)
+		for i, msg := range msgs {
+			subscriber, ok := s.subscriberFor(msg)
+			if !ok {
+				continue
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(msg *Message, result chan error) {
+				defer wg.Done()
+				defer func() { <-workers }()
+				result <- subscriber(msg)
+			}(msg, results[i])
+		}
+	}()
+
+	for i, msg := range msgs {
+		if _, ok := s.subscriberFor(msg); !ok {
+			if err := s.skip(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := <-results[i]; err != nil {
+			if err = s.failed(PhaseHandle, err); !s.continueAfter(err) {
 				return err
 			}
+		} else {
+			s.countProcessed()
+		}
+		if err := s.updateReadPosition(msg.GlobalPosition); err != nil {
+			return s.failed(PhaseWritePosition, err)
 		}
 	}
 	return nil
 }
 
-func (s *subscription) updateReadPosition(position, globalPosition int) error {
-	s.currentPosition = position
-	s.globalPosition = globalPosition
-	s.messagesSinceLastPositionWrite++
+// dropDuplicates returns msgs without the messages at or before the global
+// position already reached, counting them as skipped.
+func (s *subscription) dropDuplicates(msgs Messages) Messages {
+	reached := s.globalPosition
+	kept := make(Messages, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.GlobalPosition <= reached {
+			continue
+		}
+		reached = msg.GlobalPosition
+		kept = append(kept, msg)
+	}
+	if skipped := len(msgs) - len(kept); skipped > 0 {
+		s.updateStats(func(stats *SubscriptionStats) {
+			stats.DuplicatesSkipped += skipped
+		})
+	}
+	return kept
+}
+
+// checkOrder returns an ErrOutOfOrder if ordering checks are on and msg, which
+// has a subscriber, is not past the last message one was handed. Messages
+// without a subscriber are left out, as the read cursor does not move past
+// them and the next batch reads them again.
+func (s *subscription) checkOrder(msg *Message) error {
+	if !s.orderingChecks {
+		return nil
+	}
+	position := nextPosition(s.streamName, msg) - 1
+	if position <= s.lastDeliveredPosition {
+		return s.failed(PhaseReadBatch, ErrOutOfOrder{msg, s.lastDeliveredPosition})
+	}
+	s.lastDeliveredPosition = position
+	return nil
+}
 
-	if s.messagesSinceLastPositionWrite < s.positionUpdateInterval {
+// skip advances the read position past msg, which has no subscriber, if its
+// type is filtered out.
+func (s *subscription) skip(msg *Message) error {
+	if s.typeFilter == nil || s.typeFilter[msg.Type] {
 		return nil
 	}
+	return s.failed(PhaseWritePosition, s.updateReadPosition(msg.GlobalPosition))
+}
+
+// ackAndHandle persists the read position past msg and then hands it to
+// subscriber.
+func (s *subscription) ackAndHandle(subscriber Subscriber, msg *Message) error {
+	if err := s.writeReadPosition(s.retryPolicy, msg.GlobalPosition); err != nil {
+		return s.failed(PhaseWritePosition, err)
+	}
+	s.setGlobalPosition(msg.GlobalPosition)
+	if err := subscriber(msg); err != nil {
+		if err = s.failed(PhaseHandle, err); !s.continueAfter(err) {
+			return err
+		}
+		return nil
+	}
+	s.countProcessed()
+	return nil
+}
+
+func (s *subscription) countProcessed() {
+	s.updateStats(func(stats *SubscriptionStats) {
+		stats.Processed++
+	})
+}
+
+// updateReadPosition advances the in-memory position, writing it every
+// positionUpdateInterval messages. When that write fails the in-memory
+// position is left where it was so it never runs ahead of what was persisted
+// by a failed write.
+func (s *subscription) updateReadPosition(globalPosition int) error {
+	return s.advanceReadPosition(1, globalPosition)
+}
+
+// advanceReadPosition is updateReadPosition for n messages handled at once.
+func (s *subscription) advanceReadPosition(n, globalPosition int) error {
+	if s.messagesSinceLastPositionWrite+n >= s.positionUpdateInterval {
+		if err := s.writeReadPosition(s.retryPolicy, globalPosition); err != nil {
+			return err
+		}
+	} else {
+		s.messagesSinceLastPositionWrite += n
+	}
 
-	return s.writeReadPosition(position, globalPosition)
+	s.setGlobalPosition(globalPosition)
+
+	return nil
 }
 
-func (s *subscription) writeReadPosition(position, globalPosition int) error {
-	if position < 1 || globalPosition < 1 {
+func (s *subscription) writeReadPosition(policy RetryPolicy, globalPosition int) error {
+	if globalPosition < 1 {
 		return ErrInvalidPosition
 	}
 
+	if err := policy.Do(func() error {
+		return s.positionStore.Save(s.subscriberID, globalPosition)
+	}); err != nil {
+		return err
+	}
+
 	s.messagesSinceLastPositionWrite = 0
+	s.lastPositionWrite = s.now()
 
-	msg := NewMessage(s.subscriberStreamName, "Read")
-	msg.Data = map[string]interface{}{
-		readPositionKey:   position,
-		globalPositionKey: globalPosition,
-	}
-	_, err := s.messageDB.Write(msg)
-	return err
+	return nil
+}
+
+func isVersionConflict(err error) bool {
+	var conflict ErrVersionConflict
+	var doesNotExist ErrStreamDoesNotExist
+	return errors.As(err, &conflict) || errors.As(err, &doesNotExist)
+}
+
+// ErrOutOfOrder is the error WithOrderingChecks stops a subscription with.
+// Previous is the position of the last message handed a subscriber before
+// Message.
+type ErrOutOfOrder struct {
+	Message  *Message
+	Previous int
+}
+
+func (err ErrOutOfOrder) Error() string {
+	return fmt.Sprintf("read '%s' message %s from %s at position %d, global position %d, after position %d",
+		err.Message.Type, err.Message.ID, err.Message.StreamName, err.Message.Position, err.Message.GlobalPosition, err.Previous)
 }
 
 // ErrInvalidPosition ...
 var ErrInvalidPosition = errors.New("invalid position")
+
+// SubscriptionPhase names the step of a subscription that failed.
+type SubscriptionPhase string
+
+// The phases a SubscriptionError can report.
+const (
+	PhaseLock          SubscriptionPhase = "lock"
+	PhaseLoadPosition  SubscriptionPhase = "load position"
+	PhaseReadBatch     SubscriptionPhase = "read batch"
+	PhaseHandle        SubscriptionPhase = "handle message"
+	PhaseWritePosition SubscriptionPhase = "write position"
+)
+
+// SubscriptionError is sent on the error channel returned by Subscribe, and
+// records where the underlying error occurred.
+type SubscriptionError struct {
+	Phase        SubscriptionPhase
+	StreamName   string
+	SubscriberID string
+	Err          error
+}
+
+func (err SubscriptionError) Error() string {
+	return fmt.Sprintf("subscriber '%s' on '%s' stream failed to %s: %s", err.SubscriberID, err.StreamName, err.Phase, err.Err)
+}
+
+// Unwrap ...
+func (err SubscriptionError) Unwrap() error {
+	return err.Err
+}
+
+// failed wraps a non-nil err in a SubscriptionError for phase.
+func (s *subscription) failed(phase SubscriptionPhase, err error) error {
+	if err == nil {
+		return nil
+	}
+	return SubscriptionError{phase, s.streamName, s.subscriberID, err}
+}
@@ -0,0 +1,2145 @@
+package messagedb_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/brycedarling/messagedb"
+	"github.com/google/uuid"
+)
+
+func TestSubscriptionOnTick(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), streamName, "type", 1, 1, nil, nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	m := messagedb.New(db)
+
+	var ticks [][2]int
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		ticks = append(ticks, [2]int{processed, position})
+		if len(ticks) == 2 {
+			sub.Unsubscribe()
+		}
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	errs := sub.Subscribe(messagedb.Subscribers{
+		"type": func(m *messagedb.Message) error { return nil },
+	})
+	for err := range errs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	want := [][2]int{{1, 1}, {0, 1}}
+	if fmt.Sprint(ticks) != fmt.Sprint(want) {
+		t.Errorf("got ticks %v, want %v", ticks, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionResumesFromGlobalPosition(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), subscriberStreamName, "Read", 3, 3, []byte(`{"position":7,"globalPosition":42}`), nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 43, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionConcurrentWrites(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(false)
+
+	streamName := "stream"
+	subscriberID := "test"
+	writers := 25
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WillReturnRows(mock.NewRows(columns))
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("get_category_messages").
+			WillReturnRows(mock.NewRows(columns))
+	}
+	for i := 0; i < 2*writers; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery("write_message").
+			WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+		mock.ExpectCommit()
+	}
+
+	m := messagedb.New(db)
+
+	ticked := make(chan struct{})
+	var once sync.Once
+	sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		once.Do(func() { close(ticked) })
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	errs := sub.Subscribe(messagedb.Subscribers{})
+
+	write := func() {
+		if _, err := m.Write(messagedb.NewMessage("stream-1", "type")); err != nil {
+			t.Errorf("unexpected error '%s' when writing", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			write()
+			<-ticked
+			write()
+			sub.Unsubscribe()
+		}()
+	}
+	wg.Wait()
+
+	for err := range errs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+}
+
+func TestSubscriptionPositionWriteError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	rows := mock.NewRows(columns)
+	for i := 1; i <= 99; i++ {
+		rows.AddRow(uuid.New(), "stream-1", "type", i, i, nil, nil, time.Now())
+	}
+
+	writeErr := errors.New("write failed")
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WillReturnError(writeErr)
+	mock.ExpectRollback()
+	// The subscription stops with the 98 messages before the failed write
+	// handled, and flushes their position as it does.
+	expectPositionFlush(mock, subscriberStreamName, 98)
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handled := 0
+	var errs []error
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(m *messagedb.Message) error {
+			handled++
+			return nil
+		},
+	}) {
+		errs = append(errs, err)
+	}
+
+	if handled != 99 {
+		t.Errorf("got %d messages handled, want 99", handled)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], writeErr) {
+		t.Errorf("got errors %v, want [%s]", errs, writeErr)
+	}
+	var subErr messagedb.SubscriptionError
+	if len(errs) == 1 && (!errors.As(errs[0], &subErr) || subErr.Phase != messagedb.PhaseWritePosition) {
+		t.Errorf("got %v, want a subscription error in phase %s", errs[0], messagedb.PhaseWritePosition)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithConcurrency(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+	workers := 4
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	rows := mock.NewRows(columns)
+	for i := 1; i <= workers; i++ {
+		rows.AddRow(uuid.New(), "stream-1", "type", i, i, nil, nil, time.Now())
+	}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(rows)
+
+	expectPositionFlush(mock, subscriberStreamName, workers)
+
+	m := messagedb.New(db)
+
+	var position int
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithConcurrency(workers),
+		messagedb.WithOnTick(func(processed, globalPosition int) {
+			position = globalPosition
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	// Every handler waits for all of them to start, which only happens when
+	// they run concurrently.
+	var started sync.WaitGroup
+	started.Add(workers)
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(m *messagedb.Message) error {
+			started.Done()
+			started.Wait()
+			return nil
+		},
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if position != workers {
+		t.Errorf("got global position %d, want %d", position, workers)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithConcurrencyHandlerError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	rows := mock.NewRows(columns)
+	for i := 1; i <= 3; i++ {
+		rows.AddRow(uuid.New(), "stream-1", "type", i, i, nil, nil, time.Now())
+	}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(rows)
+	// Only the message before the failed one is flushed as handled.
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithConcurrency(2))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handlerErr := errors.New("handler failed")
+
+	var errs []error
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(m *messagedb.Message) error {
+			if m.GlobalPosition == 2 {
+				return handlerErr
+			}
+			return nil
+		},
+	}) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 1 || !errors.Is(errs[0], handlerErr) {
+		t.Errorf("got errors %v, want [%s]", errs, handlerErr)
+	}
+	var subErr messagedb.SubscriptionError
+	if len(errs) == 1 && (!errors.As(errs[0], &subErr) || subErr.Phase != messagedb.PhaseHandle || subErr.SubscriberID != subscriberID) {
+		t.Errorf("got %v, want a subscription error in phase %s", errs[0], messagedb.PhaseHandle)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionPositionWriteConflict(t *testing.T) {
+	var tests = []struct {
+		name     string
+		recorded int
+		// rewrite is whether the position is written again after the conflict
+		rewrite bool
+	}{
+		{"recorded position ahead", 150, false},
+		{"recorded position behind", 50, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "stream"
+			subscriberID := "test"
+			subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			rows := mock.NewRows(columns)
+			for i := 1; i <= 99; i++ {
+				rows.AddRow(uuid.New(), "stream-1", "type", i, i, nil, nil, time.Now())
+			}
+
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs(subscriberStreamName).
+				WillReturnRows(mock.NewRows(columns))
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(rows)
+			mock.ExpectBegin()
+			mock.ExpectQuery("write_message").
+				WithArgs(sqlmock.AnyArg(), subscriberStreamName, "Read", sqlmock.AnyArg(), sqlmock.AnyArg(), -1).
+				WillReturnError(errors.New("Wrong expected version: -1 (Stream: subscriberPosition-test, Stream Version: 0)"))
+			mock.ExpectRollback()
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs(subscriberStreamName).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), subscriberStreamName, "Read", 0, 7, []byte(fmt.Sprintf(`{"position":%d,"globalPosition":%d}`, tt.recorded, tt.recorded)), nil, time.Now()))
+			if tt.rewrite {
+				mock.ExpectBegin()
+				mock.ExpectQuery("write_message").
+					WithArgs(sqlmock.AnyArg(), subscriberStreamName, "Read", []uint8(`{"globalPosition":99}`), sqlmock.AnyArg(), 0).
+					WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("1"))
+				mock.ExpectCommit()
+			}
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 100, 100).
+				WillReturnRows(mock.NewRows(columns))
+
+			m := messagedb.New(db)
+
+			var sub messagedb.Subscription
+			sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+				if processed == 0 {
+					sub.Unsubscribe()
+				}
+			}))
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when creating subscription", err)
+			}
+
+			for err := range sub.Subscribe(messagedb.Subscribers{
+				"type": func(m *messagedb.Message) error { return nil },
+			}) {
+				t.Errorf("unexpected error '%s' when subscribed", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionIsActive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	var activeOnTick bool
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		activeOnTick = sub.IsActive()
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	if sub.IsActive() {
+		t.Error("expected subscription to be inactive before subscribing")
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if !activeOnTick {
+		t.Error("expected subscription to be active while polling")
+	}
+	if sub.IsActive() {
+		t.Error("expected subscription to be inactive after unsubscribing")
+	}
+}
+
+func TestSubscriptionOnCaughtUp(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	fullBatch := mock.NewRows(columns)
+	for i := 1; i <= 100; i++ {
+		fullBatch.AddRow(uuid.New(), "stream-1", "other", i, i, nil, nil, time.Now())
+	}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(fullBatch)
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("get_category_messages").
+			WithArgs(streamName, 1, 100).
+			WillReturnRows(mock.NewRows(columns))
+	}
+
+	m := messagedb.New(db)
+
+	var events []string
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithOnCaughtUp(func() {
+			events = append(events, "caught up")
+		}),
+		messagedb.WithOnTick(func(processed, position int) {
+			events = append(events, fmt.Sprintf("tick %d", processed))
+			if len(events) == 4 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	want := "[tick 100 caught up tick 0 tick 0]"
+	if fmt.Sprint(events) != want {
+		t.Errorf("got events %v, want %s", events, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithAdaptiveBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	batch := func(from, size int) *sqlmock.Rows {
+		rows := mock.NewRows(columns)
+		for i := from; i < from+size; i++ {
+			rows.AddRow(uuid.New(), "stream-1", "type", i, i, nil, nil, time.Now())
+		}
+		return rows
+	}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 25).
+		WillReturnRows(batch(1, 25))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 26, 25).
+		WillReturnRows(batch(26, 3))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 29, 12).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 29, 6).
+		WillReturnRows(mock.NewRows(columns))
+
+	expectPositionFlush(mock, "subscriberPosition-test", 28)
+
+	m := messagedb.New(db)
+
+	ticks := 0
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithAdaptiveBatch(5, 25),
+		messagedb.WithOnTick(func(processed, position int) {
+			if ticks++; ticks == 4 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(m *messagedb.Message) error { return nil },
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionSkipsPositionMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "subscriberPosition"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "subscriberPosition-other", messagedb.PositionMessageType, 0, 1, []byte(`{"position":1}`), nil, time.Now()).
+			AddRow(uuid.New(), subscriberStreamName, "Note", 0, 2, nil, nil, time.Now()).
+			AddRow(uuid.New(), "subscriberPosition-other", "Note", 1, 3, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 3)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []int
+	handle := func(msg *messagedb.Message) error {
+		got = append(got, msg.GlobalPosition)
+		return nil
+	}
+	errs := sub.Subscribe(messagedb.Subscribers{
+		messagedb.PositionMessageType: handle,
+		"Note":                        handle,
+	})
+	for err := range errs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []int{3}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got global positions %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionLag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), subscriberStreamName, "Read", 0, 3, []byte(`{"position":2,"globalPosition":7}`), nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 8, 100).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("max\\(global_position\\)").
+		WillReturnRows(mock.NewRows([]string{"max"}).AddRow(10))
+
+	m := messagedb.New(db)
+
+	var lag int
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		if lag, err = sub.Lag(); err != nil {
+			t.Errorf("unexpected error '%s' when reading lag", err)
+		}
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if lag != 3 {
+		t.Errorf("got lag %d, want 3", lag)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithSubscriberMiddleware(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "first", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "stream-1", "second", 1, 2, nil, nil, time.Now()))
+
+	var calls []string
+	named := func(name string) func(messagedb.Subscriber) messagedb.Subscriber {
+		return func(next messagedb.Subscriber) messagedb.Subscriber {
+			return func(msg *messagedb.Message) error {
+				calls = append(calls, name+" "+msg.Type)
+				return next(msg)
+			}
+		}
+	}
+
+	expectPositionFlush(mock, subscriberStreamName, 2)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithSubscriberMiddleware(named("outer")),
+		messagedb.WithSubscriberMiddleware(named("inner")),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handle := func(msg *messagedb.Message) error {
+		calls = append(calls, "handle "+msg.Type)
+		return nil
+	}
+	for err := range sub.Subscribe(messagedb.Subscribers{"first": handle, "second": handle}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	want := []string{"outer first", "inner first", "handle first", "outer second", "inner second", "handle second"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithAckBeforeHandle(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 0, 4, nil, nil, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), subscriberStreamName, "Read", []uint8(`{"globalPosition":4}`), []uint8("null"), -1).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithAckBeforeHandle())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handleErr := errors.New("handle failed")
+	var errs []error
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(msg *messagedb.Message) error {
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("position not written before handling: %s", err)
+			}
+			return handleErr
+		},
+	}) {
+		errs = append(errs, err)
+	}
+
+	var subErr messagedb.SubscriptionError
+	if len(errs) != 1 || !errors.As(errs[0], &subErr) || subErr.Phase != messagedb.PhaseHandle || !errors.Is(errs[0], handleErr) {
+		t.Errorf("got errors %v, want [%s] in phase %s", errs, handleErr, messagedb.PhaseHandle)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithCorrelationAndConsumerGroup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "transfers-1"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7\\)").
+		WithArgs(streamName, 1, 100, "transfer", 1, 3, nil).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-2", "Withdrawn", 0, 4, nil, []byte(`{"correlationStreamName":"transfer-1"}`), time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 4)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithCorrelation("transfer"),
+		messagedb.WithConsumerGroup(1, 3),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []int
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"Withdrawn": func(msg *messagedb.Message) error {
+			got = append(got, msg.GlobalPosition)
+			return nil
+		},
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []int{4}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got global positions %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionFilterValidation(t *testing.T) {
+	var tests = []struct {
+		name       string
+		streamName string
+		opts       []messagedb.SubscriptionOption
+		err        error
+	}{
+		{"entity stream", "account-1", []messagedb.SubscriptionOption{messagedb.WithCorrelation("transfer")}, messagedb.ErrInvalidCategory},
+		{"correlation stream", "account", []messagedb.SubscriptionOption{messagedb.WithCorrelation("transfer-1")}, messagedb.ErrInvalidCategory},
+		{"member outside group", "account", []messagedb.SubscriptionOption{messagedb.WithConsumerGroup(3, 3)}, messagedb.ErrInvalidConsumerGroup},
+		{"negative member", "account", []messagedb.SubscriptionOption{messagedb.WithConsumerGroup(-1, 3)}, messagedb.ErrInvalidConsumerGroup},
+		{"correlated group", "account", []messagedb.SubscriptionOption{messagedb.WithCorrelation("transfer"), messagedb.WithConsumerGroup(0, 3)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if _, err := messagedb.New(db).CreateSubscription(tt.streamName, "test", tt.opts...); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionBatchHandlerWithAckBeforeHandle(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	_, err = messagedb.New(db).CreateSubscription("account", "test",
+		messagedb.WithBatchHandler(func(messagedb.Messages) error { return nil }),
+		messagedb.WithAckBeforeHandle())
+	if err != messagedb.ErrAckBeforeHandleConflict {
+		t.Errorf("got %v, want error %s", err, messagedb.ErrAckBeforeHandleConflict)
+	}
+}
+
+func TestSubscriptionWithReconnect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	connErr := errors.New("connection refused")
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnError(connErr)
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnError(connErr)
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), subscriberStreamName, "Read", 0, 3, []byte(`{"position":2,"globalPosition":5}`), nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 6, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 3, 6, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 6)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithReconnect(messagedb.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []int
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(msg *messagedb.Message) error {
+			got = append(got, msg.GlobalPosition)
+			return nil
+		},
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []int{6}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got global positions %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithTypeFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Withdrawn", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Deposited", 1, 2, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-1", "Closed", 2, 3, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 3)
+
+	m := messagedb.New(db)
+
+	var reached int
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithTypeFilter([]string{"Deposited"}),
+		messagedb.WithOnTick(func(processed, position int) {
+			reached = position
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var got []string
+	handle := func(msg *messagedb.Message) error {
+		got = append(got, msg.Type)
+		return nil
+	}
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": handle, "Withdrawn": handle}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if want := []string{"Deposited"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got types %v, want %v", got, want)
+	}
+	if reached != 3 {
+		t.Errorf("got position %d, want 3", reached)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+// memoryPositionStore is a PositionStore that keeps positions in a map.
+type memoryPositionStore struct {
+	positions map[string]int
+}
+
+func (p *memoryPositionStore) Load(subscriberID string) (int, error) {
+	return p.positions[subscriberID], nil
+}
+
+func (p *memoryPositionStore) Save(subscriberID string, position int) error {
+	p.positions[subscriberID] = position
+	return nil
+}
+
+func TestSubscriptionWithPositionStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 6, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 0, 6, nil, nil, time.Now()))
+
+	store := &memoryPositionStore{positions: map[string]int{subscriberID: 5}}
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithPositionStore(store),
+		messagedb.WithAckBeforeHandle(),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(msg *messagedb.Message) error { return nil },
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if position := store.positions[subscriberID]; position != 6 {
+		t.Errorf("got saved position %d, want 6", position)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+// expectPositionFlush expects the position write made when a subscription is
+// unsubscribed after handling messages.
+func expectPositionFlush(mock sqlmock.Sqlmock, subscriberStreamName string, globalPosition int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("write_message").
+		WithArgs(sqlmock.AnyArg(), subscriberStreamName, "Read", []uint8(fmt.Sprintf(`{"globalPosition":%d}`, globalPosition)), []uint8("null"), sqlmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"next_position"}).FromCSVString("0"))
+	mock.ExpectCommit()
+}
+
+func TestSubscriptionWithPositionFlushInterval(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 0, 1, nil, nil, time.Now()))
+	expectPositionFlush(mock, subscriberStreamName, 1)
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	ticks := 0
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithPositionFlushInterval(time.Nanosecond),
+		messagedb.WithOnTick(func(processed, position int) {
+			if ticks++; ticks == 2 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(msg *messagedb.Message) error { return nil },
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithOneOpenConnection(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	// The position is written partway through the batch, which needs the
+	// only connection the read has finished with.
+	rows := mock.NewRows(columns)
+	for i := 1; i <= 100; i++ {
+		rows.AddRow(uuid.New(), "stream-1", "type", i-1, i, nil, nil, time.Now())
+	}
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(rows)
+	expectPositionFlush(mock, subscriberStreamName, 99)
+	expectPositionFlush(mock, subscriberStreamName, 100)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOnTick(func(processed, position int) {
+		sub.Unsubscribe()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range sub.Subscribe(messagedb.Subscribers{
+			"type": func(msg *messagedb.Message) error { return nil },
+		}) {
+			t.Errorf("unexpected error '%s' when subscribed", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription deadlocked on the pool's one connection")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithPositionFlushIntervalAndClock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "stream"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "stream-1", "type", 0, 1, nil, nil, time.Now()))
+	expectPositionFlush(mock, subscriberStreamName, 1)
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	// The clock stands still until the handler moves it on an hour, which
+	// makes the flush due without waiting for it.
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	m := messagedb.New(db, messagedb.WithClock(clock))
+
+	ticks := 0
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithPositionFlushInterval(time.Hour),
+		messagedb.WithOnTick(func(processed, position int) {
+			if ticks++; ticks == 2 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{
+		"type": func(msg *messagedb.Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			now = now.Add(time.Hour)
+			return nil
+		},
+	}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithOrderingChecks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 2, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 2, nil, nil, time.Now()))
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithOrderingChecks())
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handled := 0
+	var got []error
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+		handled++
+		return nil
+	}}) {
+		got = append(got, err)
+	}
+
+	var orderErr messagedb.ErrOutOfOrder
+	if len(got) != 1 || !errors.As(got[0], &orderErr) {
+		t.Fatalf("got errors %v, want one ErrOutOfOrder", got)
+	}
+	if orderErr.Previous != 2 || orderErr.Message.GlobalPosition != 2 {
+		t.Errorf("got global position %d after %d, want 2 after 2", orderErr.Message.GlobalPosition, orderErr.Previous)
+	}
+	if handled != 2 {
+		t.Errorf("got %d messages handled, want 2", handled)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithOrderingChecksAndTrailingUnhandledMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+	other := uuid.New()
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(other, "account-1", "Other", 1, 2, nil, nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(other, "account-1", "Other", 1, 2, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	m := messagedb.New(db)
+
+	ticks := 0
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID, messagedb.WithOrderingChecks(),
+		messagedb.WithOnTick(func(processed, position int) {
+			if ticks++; ticks == 2 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handled := 0
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+		handled++
+		return nil
+	}}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if handled != 1 {
+		t.Errorf("got %d messages handled, want 1", handled)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 2, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 2, nil, nil, time.Now()))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 3, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	expectPositionFlush(mock, subscriberStreamName, 2)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithOnTick(func(processed, position int) {
+			if processed == 0 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error { return nil }}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	want := messagedb.SubscriptionStats{Processed: 2, Position: 2, Ticks: 2, IdleTicks: 1, DuplicatesSkipped: 1}
+	if got := sub.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithErrorPolicy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-2", "Deposited", 0, 2, nil, nil, time.Now()).
+			AddRow(uuid.New(), "account-3", "Deposited", 0, 3, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 3)
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithErrorPolicy(messagedb.ContinueOnError),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	handlerErr := errors.New("handler failed")
+	var handled []int
+	var got []error
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(msg *messagedb.Message) error {
+		if msg.GlobalPosition == 2 {
+			return handlerErr
+		}
+		handled = append(handled, msg.GlobalPosition)
+		return nil
+	}}) {
+		got = append(got, err)
+	}
+
+	var subErr messagedb.SubscriptionError
+	if len(got) != 1 || !errors.As(got[0], &subErr) || subErr.Phase != messagedb.PhaseHandle || !errors.Is(got[0], handlerErr) {
+		t.Errorf("got errors %v, want one handler error", got)
+	}
+	if want := []int{1, 3}; fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Errorf("got %v handled, want %v", handled, want)
+	}
+	if stats := sub.Stats(); stats.LastError == nil || stats.Processed != 2 {
+		t.Errorf("got stats %+v, want 2 processed and the handler error", stats)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithBatchHandler(t *testing.T) {
+	var tests = []struct {
+		name       string
+		handlerErr error
+		position   int
+	}{
+		{"success", nil, 3},
+		{"failure", errors.New("batch failed"), 0},
+	}
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		streamName := "account"
+		subscriberID := "test"
+		subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+		columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+		mock.ExpectQuery("get_last_stream_message").
+			WithArgs(subscriberStreamName).
+			WillReturnRows(mock.NewRows(columns))
+		mock.ExpectQuery("get_category_messages").
+			WithArgs(streamName, 1, 100).
+			WillReturnRows(mock.NewRows(columns).
+				AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+				AddRow(uuid.New(), "account-2", "Closed", 0, 2, nil, nil, time.Now()).
+				AddRow(uuid.New(), "account-1", "Withdrawn", 1, 3, nil, nil, time.Now()))
+
+		if test.handlerErr == nil {
+			expectPositionFlush(mock, subscriberStreamName, 3)
+		}
+
+		m := messagedb.New(db)
+
+		var got []string
+		var sub messagedb.Subscription
+		sub, err = m.CreateSubscription(streamName, subscriberID,
+			messagedb.WithTypeFilter([]string{"Deposited", "Withdrawn"}),
+			messagedb.WithBatchHandler(func(msgs messagedb.Messages) error {
+				for _, msg := range msgs {
+					got = append(got, msg.Type)
+				}
+				return test.handlerErr
+			}),
+			messagedb.WithOnTick(func(processed, position int) {
+				sub.Unsubscribe()
+			}))
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s' when creating subscription", test.name, err)
+		}
+
+		var errs []error
+		for err := range sub.Subscribe(nil) {
+			errs = append(errs, err)
+		}
+
+		if want := []string{"Deposited", "Withdrawn"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got batch %v, want %v", test.name, got, want)
+		}
+		if test.handlerErr == nil && len(errs) != 0 {
+			t.Errorf("%s: got errors %v, want none", test.name, errs)
+		}
+		if test.handlerErr != nil && (len(errs) != 1 || !errors.Is(errs[0], test.handlerErr)) {
+			t.Errorf("%s: got errors %v, want %s", test.name, errs, test.handlerErr)
+		}
+		if got := sub.Stats().Position; got != test.position {
+			t.Errorf("%s: got position %d, want %d", test.name, got, test.position)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unmet expectations: %s", test.name, err)
+		}
+	}
+}
+
+func TestSubscriptionContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	type traceKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace-1"))
+	defer cancel()
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	var trace interface{}
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+		trace = sub.Context().Value(traceKey{})
+		cancel()
+		return nil
+	}}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	if trace != "trace-1" {
+		t.Errorf("got trace %v, want trace-1", trace)
+	}
+	if sub.Context().Err() == nil {
+		t.Error("expected the subscription's context to be done once it stopped")
+	}
+	if sub.IsActive() {
+		t.Error("expected the subscription to stop when its parent context was cancelled")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithLogger(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+
+	expectPositionFlush(mock, subscriberStreamName, 1)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithLogger(logger),
+		messagedb.WithOnTick(func(processed, position int) {
+			sub.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(msg *messagedb.Message) error {
+		sub.Logger().Info("handled", "globalPosition", msg.GlobalPosition)
+		return nil
+	}}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, want := range []string{`msg="subscription started"`, "msg=handled", `msg="subscription caught up"`, `msg="subscription stopped"`} {
+		found := false
+		for _, line := range lines {
+			found = found || strings.Contains(line, want)
+		}
+		if !found {
+			t.Errorf("got log %q, want a line with %s", buf.String(), want)
+		}
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "streamName=account subscriberID=test") {
+			t.Errorf("got log line %q, want the subscription's identity", line)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionPauseAndResume(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+	// Pausing flushes the position, and resuming reads on from it without
+	// loading it again.
+	expectPositionFlush(mock, subscriberStreamName, 1)
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 2, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	var sub messagedb.Subscription
+	sub, err = m.CreateSubscription(streamName, subscriberID,
+		messagedb.WithOnTick(func(processed, position int) {
+			if processed == 0 {
+				sub.Unsubscribe()
+			}
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	resumed := make(chan struct{})
+	errs := sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+		sub.Pause()
+		go func() {
+			defer close(resumed)
+			time.Sleep(300 * time.Millisecond)
+			if !sub.IsActive() {
+				t.Error("expected a paused subscription to stay active")
+			}
+			if ticks := sub.Stats().Ticks; ticks != 1 {
+				t.Errorf("got %d ticks while paused, want 1", ticks)
+			}
+			sub.Resume()
+		}()
+		return nil
+	}})
+	for err := range errs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+	<-resumed
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionWithMaxConcurrentPolls(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs("subscriberPosition-first").
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("account", 1, 100).
+		WillDelayFor(300 * time.Millisecond).
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+	expectPositionFlush(mock, "subscriberPosition-first", 1)
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs("subscriberPosition-second").
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs("transfer", 1, 100).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db, messagedb.WithMaxConcurrentPolls(1))
+
+	first, err := m.CreateSubscription("account", "first")
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+	secondTicked := make(chan struct{})
+	var second messagedb.Subscription
+	second, err = m.CreateSubscription("transfer", "second",
+		messagedb.WithOnTick(func(processed, position int) {
+			close(secondTicked)
+			second.Unsubscribe()
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	// The first subscription keeps its turn while its read is running, so
+	// the second waits for it, but gives it up before handling what it read,
+	// so the second reads while the first is still handling.
+	firstErrs := first.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+		select {
+		case <-secondTicked:
+		case <-time.After(5 * time.Second):
+			t.Errorf("second subscription did not read while the first was handling")
+		}
+		first.Unsubscribe()
+		return nil
+	}})
+	time.Sleep(100 * time.Millisecond)
+	secondErrs := second.Subscribe(messagedb.Subscribers{})
+
+	for err := range firstErrs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+	for err := range secondErrs {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+	if wait := second.Stats().PollWait; wait == 0 {
+		t.Errorf("got poll wait %s, want the time spent waiting for the first subscription", wait)
+	}
+	if wait := first.Stats().PollWait; wait != 0 {
+		t.Errorf("got poll wait %s, want none for the first subscription", wait)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}
+
+func TestSubscriptionFlushesPositionWhenFailing(t *testing.T) {
+	var tests = []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock, streamName string, columns []string)
+		phase  messagedb.SubscriptionPhase
+	}{
+		{"handler error", func(mock sqlmock.Sqlmock, streamName string, columns []string) {
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()).
+					AddRow(uuid.New(), "account-1", "Failed", 1, 2, nil, nil, time.Now()))
+		}, messagedb.PhaseHandle},
+		{"read error", func(mock sqlmock.Sqlmock, streamName string, columns []string) {
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 2, 100).
+				WillReturnError(errConnectionReset)
+		}, messagedb.PhaseReadBatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "account"
+			subscriberID := "test"
+			subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs(subscriberStreamName).
+				WillReturnRows(mock.NewRows(columns))
+			tt.expect(mock, streamName, columns)
+			expectPositionFlush(mock, subscriberStreamName, 1)
+
+			m := messagedb.New(db)
+
+			sub, err := m.CreateSubscription(streamName, subscriberID)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when creating subscription", err)
+			}
+
+			var errs []error
+			for err := range sub.Subscribe(messagedb.Subscribers{
+				"Deposited": func(*messagedb.Message) error { return nil },
+				"Failed":    func(*messagedb.Message) error { return errors.New("handler failed") },
+			}) {
+				errs = append(errs, err)
+			}
+
+			var subErr messagedb.SubscriptionError
+			if len(errs) != 1 || !errors.As(errs[0], &subErr) || subErr.Phase != tt.phase {
+				t.Errorf("got errors %v, want one in phase %s", errs, tt.phase)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionRetriesFinalPositionFlush(t *testing.T) {
+	var tests = []struct {
+		name   string
+		opts   []messagedb.SubscriptionOption
+		failed bool
+	}{
+		{"default policy", nil, false},
+		{"single attempt", []messagedb.SubscriptionOption{messagedb.WithFinalFlushRetryPolicy(messagedb.RetryPolicy{MaxAttempts: 1})}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "account"
+			subscriberID := "test"
+			subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs(subscriberStreamName).
+				WillReturnRows(mock.NewRows(columns))
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+			mock.ExpectBegin().WillReturnError(errConnectionReset)
+			if !tt.failed {
+				expectPositionFlush(mock, subscriberStreamName, 1)
+			}
+
+			m := messagedb.New(db)
+
+			sub, err := m.CreateSubscription(streamName, subscriberID, tt.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when creating subscription", err)
+			}
+
+			var errs []error
+			for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+				sub.Unsubscribe()
+				return nil
+			}}) {
+				errs = append(errs, err)
+			}
+			if tt.failed && (len(errs) != 1 || !errors.Is(errs[0], errConnectionReset)) {
+				t.Errorf("got errors %v, want the failed position write", errs)
+			}
+			if !tt.failed && len(errs) != 0 {
+				t.Errorf("got errors %v, want the position write retried", errs)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionReportsErrorsAfterContextDone(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	var tests = []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"context error", context.Canceled, false},
+		{"wrapped context error", fmt.Errorf("handling: %w", context.Canceled), false},
+		{"other error", errBoom, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			streamName := "account"
+			subscriberID := "test"
+			subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+			columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+			mock.ExpectQuery("get_last_stream_message").
+				WithArgs(subscriberStreamName).
+				WillReturnRows(mock.NewRows(columns))
+			mock.ExpectQuery("get_category_messages").
+				WithArgs(streamName, 1, 100).
+				WillReturnRows(mock.NewRows(columns).
+					AddRow(uuid.New(), "account-1", "Deposited", 0, 1, nil, nil, time.Now()))
+
+			m := messagedb.New(db)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sub, err := m.CreateSubscription(streamName, subscriberID, messagedb.WithContext(ctx))
+			if err != nil {
+				t.Fatalf("unexpected error '%s' when creating subscription", err)
+			}
+
+			var got []error
+			for err := range sub.Subscribe(messagedb.Subscribers{"Deposited": func(*messagedb.Message) error {
+				cancel()
+				return tt.err
+			}}) {
+				got = append(got, err)
+			}
+
+			if tt.wantErr && (len(got) != 1 || !errors.Is(got[0], tt.err)) {
+				t.Errorf("got errors %v, want %s", got, tt.err)
+			}
+			if !tt.wantErr && len(got) != 0 {
+				t.Errorf("got errors %v, want none", got)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionUnsubscribeCancelsRead(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	streamName := "account"
+	subscriberID := "test"
+	subscriberStreamName := fmt.Sprintf("subscriberPosition-%s", subscriberID)
+
+	columns := []string{"id", "name", "type", "position", "global_position", "data", "metadata", "time"}
+
+	mock.ExpectQuery("get_last_stream_message").
+		WithArgs(subscriberStreamName).
+		WillReturnRows(mock.NewRows(columns))
+	mock.ExpectQuery("get_category_messages").
+		WithArgs(streamName, 1, 100).
+		WillDelayFor(5 * time.Second).
+		WillReturnRows(mock.NewRows(columns))
+
+	m := messagedb.New(db)
+
+	sub, err := m.CreateSubscription(streamName, subscriberID)
+	if err != nil {
+		t.Fatalf("unexpected error '%s' when creating subscription", err)
+	}
+
+	time.AfterFunc(300*time.Millisecond, sub.Unsubscribe)
+	start := time.Now()
+	for err := range sub.Subscribe(messagedb.Subscribers{}) {
+		t.Errorf("unexpected error '%s' when subscribed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s to stop, want the read cancelled by Unsubscribe", elapsed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %s", err)
+	}
+}